@@ -0,0 +1,168 @@
+package maestro
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redacted = "[redacted]"
+
+// Secret is a credential, it's redacted when printed, logged or json encoded
+type Secret string
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+func (s Secret) GoString() string {
+	return fmt.Sprintf("%q", s.String())
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// Reveal is the actual secret, for the request headers only
+func (s Secret) Reveal() string {
+	return string(s)
+}
+
+// Auth authenticates the requests to maestro
+type Auth interface {
+	// Authenticate sets the credentials of r, it's called for every request
+	Authenticate(r *http.Request) error
+}
+
+// tlsAuth are the Auth strategies authenticating the connection instead of the requests
+type tlsAuth interface {
+	TLSConfig() *tls.Config
+}
+
+// BasicAuth sends a username and password on every request
+type BasicAuth struct {
+	Username string
+	Password Secret
+}
+
+func (a BasicAuth) Authenticate(r *http.Request) error {
+	r.SetBasicAuth(a.Username, a.Password.Reveal())
+	return nil
+}
+
+// BearerToken sends a static token on every request
+type BearerToken struct {
+	Token Secret
+}
+
+func (a BearerToken) Authenticate(r *http.Request) error {
+	r.Header.Set("Authorization", "Bearer "+a.Token.Reveal())
+	return nil
+}
+
+// FileToken sends the bearer token read from a file, the file is read again once it changes
+// so rotated tokens are picked up without a restart
+type FileToken struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	token   Secret
+}
+
+// NewFileToken reads the token at path, it fails when the file can't be read or is empty
+func NewFileToken(path string) (*FileToken, error) {
+	a := &FileToken{path: path}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *FileToken) Authenticate(r *http.Request) error {
+	if err := a.reload(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	token := a.token
+	a.mu.Unlock()
+	r.Header.Set("Authorization", "Bearer "+token.Reveal())
+	return nil
+}
+
+// reload reads the token when the file changed, on failure the previous token is kept
+func (a *FileToken) reload() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	info, err := os.Stat(a.path)
+	if err != nil {
+		if a.token != "" {
+			return nil
+		}
+		return fmt.Errorf("maestro token file: %w", err)
+	}
+	if a.token != "" && info.ModTime().Equal(a.modTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		if a.token != "" {
+			return nil
+		}
+		return fmt.Errorf("maestro token file: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		if a.token != "" {
+			return nil
+		}
+		return fmt.Errorf("maestro token file %v is empty", a.path)
+	}
+	a.token, a.modTime = Secret(token), info.ModTime()
+	return nil
+}
+
+// MTLS authenticates the connections to maestro with a client certificate
+type MTLS struct {
+	config *tls.Config
+}
+
+// NewMTLS loads the client certificate and key, and the CA of the maestro hosts when caFile is set
+// (the system roots are used otherwise)
+func NewMTLS(certFile, keyFile, caFile string) (*MTLS, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("maestro client certificate: %w", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("maestro CA: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("maestro CA: no certificates in %v", caFile)
+		}
+	}
+	return &MTLS{config: config}, nil
+}
+
+// Authenticate is a no-op, the certificate is presented on the connection handshake
+func (a *MTLS) Authenticate(*http.Request) error {
+	return nil
+}
+
+func (a *MTLS) TLSConfig() *tls.Config {
+	return a.config
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -15,20 +16,31 @@ import (
 	"github.com/pkg/errors"
 )
 
-// Maestro is the interface for machine translation services in arch2
+// Maestro is the interface for machine translation services in arch2,
+// one method per maestro flow
 type Maestro interface {
-	MTTask(ctx context.Context,
-		serviceURL string,
-		req *maestro.MTTaskRequest) (*maestro.MTTaskResponse, error)
+	MachineTranslate(ctx context.Context, serviceURL string, req *MTRequest) (*MTResponse, error)
+	MachineTranslateWithQE(ctx context.Context, serviceURL string, req *MTQERequest) (*MTQEResponse, error)
+	PivotedMachineTranslate(
+		ctx context.Context, serviceURL string, req *PivotedMTRequest) (*PivotedMTResponse, error)
+	PivotedMachineTranslateWithQE(
+		ctx context.Context, serviceURL string, req *PivotedMTQERequest) (*PivotedMTQEResponse, error)
+	Rebuild(ctx context.Context, serviceURL string, req *RebuildRequest) (*RebuildResponse, error)
+	PivotedRebuild(
+		ctx context.Context, serviceURL string, req *PivotedRebuildRequest) (*PivotedRebuildResponse, error)
 }
 
 type maestroClient struct {
-	authUsername string
-	authPassword string
+	auth Auth
 	// MT & MTQE request durations are proportional to character (utf8) input size
 	charsPerSecondTimeout float64
 	logger                log.Logger
 	httpClient            *retryablehttp.Client
+	metrics               Metrics
+	retryPolicy           RetryPolicy
+	retryBudget           *retryBudget
+	// nil unless SetAdaptiveTimeouts
+	timeouts *endpointTimeouts
 }
 
 const (
@@ -42,15 +54,18 @@ const (
 	pivotedRebuildPath                               = "v1/pivoted_rebuild"
 	defaultRetryDelayMin                             = 50 * time.Millisecond // the retryablehttp default is 1 second..
 	defaultRetryMax                                  = 3                     // 4 reqs in total
+	defaultRetryDelayMax                             = 30 * time.Second
 
 	metricTimingMT              = "chat2_timing_maestro_mt_secs"
 	metricTimingMTWithQE        = "chat2_timing_maestro_mt_with_qe_secs"
 	metricTimingPivotedMT       = "chat2_timing_maestro_pivoted_mt_secs"
 	metricTimingPivotedMTWithQE = "chat2_timing_maestro_pivoted_mt_with_qe_secs"
 	metricTimingRebuild         = "chat2_timing_maestro_rebuild_secs"
+	metricTimingPivotedRebuild  = "chat2_timing_maestro_pivoted_rebuild_secs"
 )
 
-// New returns a maestroClient with request timeouts, cancellation and retry logic
+// New returns a maestroClient authenticated with basic auth, with request timeouts,
+// cancellation and retry logic
 func New(
 	logger log.Logger,
 	basicAuthUser,
@@ -58,70 +73,152 @@ func New(
 	charsPerSecondTimeout float64,
 ) *maestroClient {
 
-	if basicAuthUser == "" || basicAuthPass == "" || charsPerSecondTimeout <= 0 {
+	if basicAuthUser == "" || basicAuthPass == "" {
 		logger.Log("maestro", "Bad Arguments",
 			"basicAuthUser", basicAuthUser,
-			"basicAuthPass", basicAuthPass,
+			"basicAuthPass", Secret(basicAuthPass),
+			"charsPerSecondTimeout", charsPerSecondTimeout,
+		)
+		return nil
+	}
+	return NewWithAuth(logger, BasicAuth{Username: basicAuthUser, Password: Secret(basicAuthPass)},
+		charsPerSecondTimeout)
+}
+
+// NewWithAuth returns a maestroClient authenticated by auth, with request timeouts,
+// cancellation and retry logic
+func NewWithAuth(logger log.Logger, auth Auth, charsPerSecondTimeout float64) *maestroClient {
+	if auth == nil || charsPerSecondTimeout <= 0 {
+		logger.Log("maestro", "Bad Arguments",
+			"auth", fmt.Sprintf("%T", auth),
 			"charsPerSecondTimeout", charsPerSecondTimeout,
 		)
 		return nil
 	}
 	m := &maestroClient{
-		authUsername:          basicAuthUser,
-		authPassword:          basicAuthPass,
+		auth:                  auth,
 		charsPerSecondTimeout: charsPerSecondTimeout,
 		httpClient:            retryablehttp.NewClient(),
 		logger:                logger,
+		metrics:               prometheusMetrics{},
+	}
+	m.SetRetryPolicy(DefaultRetryPolicy)
+	m.httpClient.RequestLogHook = countAttempts
+	m.httpClient.ResponseLogHook = recordStatus
+	if a, ok := auth.(tlsAuth); ok {
+		if t, ok := m.httpClient.HTTPClient.Transport.(*http.Transport); ok {
+			t.TLSClientConfig = a.TLSConfig()
+		}
 	}
-	m.httpClient.RetryWaitMin = defaultRetryDelayMin
-	m.httpClient.RetryMax = defaultRetryMax
 	return m
 }
 
-func (c *maestroClient) MTTask(
-	ctx context.Context, serviceURL string, req *maestro.MTTaskRequest) (*maestro.MTResponse, error) {
+func (c *maestroClient) MachineTranslate(
+	ctx context.Context, serviceURL string, req *MTRequest) (*MTResponse, error) {
+	var resp MTResponse
+	err := c.call(ctx, serviceURL, machineTranslatePath, req.UID, req.Text, req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *maestroClient) MachineTranslateWithQE(
+	ctx context.Context, serviceURL string, req *MTQERequest) (*MTQEResponse, error) {
+	var resp MTQEResponse
+	err := c.call(ctx, serviceURL, machineTranslateWithQualityEstimationPath, req.UID, req.Text, req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *maestroClient) PivotedMachineTranslate(
+	ctx context.Context, serviceURL string, req *PivotedMTRequest) (*PivotedMTResponse, error) {
+	var resp PivotedMTResponse
+	err := c.call(ctx, serviceURL, pivotedMachineTranslatePath, req.UID, req.Text, req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
 
-	startTime := time.Now()
+func (c *maestroClient) PivotedMachineTranslateWithQE(
+	ctx context.Context, serviceURL string, req *PivotedMTQERequest) (*PivotedMTQEResponse, error) {
+	var resp PivotedMTQEResponse
+	err := c.call(ctx, serviceURL, pivotedMachineTranslateWithQualityEstimationPath, req.UID, req.Text, req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
 
-	respBuffer, err := c.callMachineTranslate(ctx, serviceURL, req, machineTranslatePath)
+func (c *maestroClient) Rebuild(
+	ctx context.Context, serviceURL string, req *RebuildRequest) (*RebuildResponse, error) {
+	var resp RebuildResponse
+	err := c.call(ctx, serviceURL, rebuildPath, req.UID, req.Text, req, &resp)
 	if err != nil {
 		return nil, err
 	}
+	return &resp, nil
+}
 
-	var resp maestro.MTResponse
-	err = ParseMTResponse(respBuffer, &resp)
+func (c *maestroClient) PivotedRebuild(
+	ctx context.Context, serviceURL string, req *PivotedRebuildRequest) (*PivotedRebuildResponse, error) {
+	var resp PivotedRebuildResponse
+	err := c.call(ctx, serviceURL, pivotedRebuildPath, req.UID, req.Text, req, &resp)
 	if err != nil {
-		err = errors.Wrap(err, "maestro response parsing failed")
-		c.logger.Log("maestro", req, "error", err)
 		return nil, err
 	}
 	return &resp, nil
 }
 
-func (c *maestroClient) callMachineTranslate(
+// call POSTs req to the maestro flow at path and decodes its response into resp,
+// the timeout is proportional to the text size
+func (c *maestroClient) call(
+	ctx context.Context, serviceURL, path, uid, text string, req, resp interface{}) error {
+
+	respBuffer, err := c.post(ctx, serviceURL, path, uid, text, req)
+	if err != nil {
+		return err
+	}
+	err = maestro.ParseResponse(respBuffer, resp)
+	if err != nil {
+		err = errors.Wrapf(err, "maestro %v response parsing failed", flowName(path))
+		c.logger.Log("client", "maestro", "uid", uid, "path", path, "error", err)
+		return err
+	}
+	return nil
+}
+
+func (c *maestroClient) post(
 	ctx context.Context,
 	MTModelURL string,
-	req *maestro.MTRequest,
 	path string,
+	uid string,
+	text string,
+	req interface{},
 ) ([]byte, error) {
 
 	body, err := json.Marshal(req)
 	if err != nil {
 		err = errors.Wrap(err, "maestro request json marshal failed")
-		c.logger.Log("client", "maestro", "uid", req.UID, "step", "json.Marshal", "error", err)
+		c.logger.Log("client", "maestro", "uid", uid, "step", "json.Marshal", "error", err)
 		return nil, err
 	}
 
 	if MTModelURL == "" {
 		err := errors.New("invalid argument: MTModelURL cannot be empty")
-		c.logger.Log("client", "maestro", "uid", req.UID, "argument", err)
+		c.logger.Log("client", "maestro", "uid", uid, "argument", err)
 		return nil, err
 	}
 
-	timeout := getTimeoutForRequestPayload(path, req.Text, c.charsPerSecondTimeout)
-	c.logger.Log("client", "maestro", "uid", req.UID, "timeout", timeout)
+	timeout := c.timeoutFor(MTModelURL, path, text)
+	c.logger.Log("client", "maestro", "uid", uid, "path", path, "timeout", timeout)
+	parent := ctx
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
+	ctx, attempts := withAttempts(ctx)
 
 	r, err := retryablehttp.NewRequest(
 		"POST",
@@ -130,35 +227,72 @@ func (c *maestroClient) callMachineTranslate(
 	)
 	if err != nil {
 		err = errors.Wrap(err, "maestro http request creation failed")
-		c.logger.Log("client", "maestro", "uid", req.UID, "error", err)
+		c.logger.Log("client", "maestro", "uid", uid, "error", err)
+		return nil, err
+	}
+	r = r.WithContext(ctx)
+	if err := c.auth.Authenticate(r.Request); err != nil {
+		err = errors.Wrap(err, "maestro request authentication failed")
+		c.logger.Log("client", "maestro", "uid", uid, "error", err)
 		return nil, err
 	}
-	r.WithContext(ctx)
-	r.SetBasicAuth(c.authUsername, c.authPassword)
 	r.Header.Set("Content-Type", "application/json")
 
+	c.retryBudget.deposit()
+	start := time.Now()
 	httpResp, err := c.httpClient.Do(r)
+	if httpResp != nil {
+		attempts.statusCode = httpResp.StatusCode
+	}
+	elapsed := time.Since(start)
+	c.metrics.ObserveRequest(path, hostOf(MTModelURL), statusClass(attempts.statusCode), attempts.retries, elapsed)
+	switch {
+	case err == nil && attempts.retries == 0 && isValidResponseStatusCode(httpResp):
+		c.timeouts.observe(MTModelURL, path, len(text), elapsed, false)
+	case ctx.Err() == context.DeadlineExceeded && parent.Err() == nil:
+		// timed out by us, it was at least this slow
+		c.timeouts.observe(MTModelURL, path, len(text), elapsed, true)
+	}
 	if err != nil {
-		err = errors.Wrap(err, "maestro mt http request failed")
-		c.logger.Log("client", "maestro", "uid", req.UID, "error", err)
+		err = errors.Wrapf(err, "maestro %v http request failed", flowName(path))
+		c.logger.Log("client", "maestro", "uid", uid, "error", err)
 		return nil, err
 	}
 	defer httpResp.Body.Close()
 
 	if !isValidResponseStatusCode(httpResp) {
-		return nil, errors.Errorf("received %v response from maestro mt request",
-			httpResp.StatusCode)
+		return nil, &StatusError{StatusCode: httpResp.StatusCode, Flow: flowName(path)}
 	}
 
 	data, err := ioutil.ReadAll(httpResp.Body)
 	if err != nil {
-		err = errors.Wrap(err, "maestro read mt http response failed")
-		c.logger.Log("client", "maestro", "uid", req.UID, "error", err)
+		err = errors.Wrapf(err, "maestro read %v http response failed", flowName(path))
+		c.logger.Log("client", "maestro", "uid", uid, "error", err)
 		return nil, err
 	}
 	return data, nil
 }
 
+// flowName is the maestro flow served at path, e.g. mt or pivoted_rebuild
+func flowName(path string) string {
+	return strings.TrimPrefix(path, "v1/")
+}
+
+// StatusError is returned for non 2XX maestro responses that weren't retried (or ran out of retries)
+type StatusError struct {
+	StatusCode int
+	// Flow is the maestro flow that failed, mt when empty
+	Flow string
+}
+
+func (e *StatusError) Error() string {
+	flow := e.Flow
+	if flow == "" {
+		flow = flowName(machineTranslatePath)
+	}
+	return fmt.Sprintf("received %v response from maestro %v request", e.StatusCode, flow)
+}
+
 func durationForTextSize(textLen int, charsPerSecond float64) time.Duration {
 	millis := float64(textLen) / charsPerSecond * 1000.0
 	return time.Duration(millis) * time.Millisecond
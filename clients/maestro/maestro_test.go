@@ -10,6 +10,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -941,3 +945,115 @@ func TestProportionalRequestTimeout(t *testing.T) {
 
 	}
 }
+
+func TestFlowsPostToTheirPath(t *testing.T) {
+	maestroClient := New(log.NewNopLogger(), "user", "pass", DefaultCharsPersSecondTimeout)
+	var paths []string
+	maestroClient.httpClient.HTTPClient = newHTTPClient(
+		func(req *http.Request) *http.Response {
+			paths = append(paths, req.URL.Path)
+			return &http.Response{
+				StatusCode: 422,
+				Body:       ioutil.NopCloser(bytes.NewBufferString("")),
+				Header:     make(http.Header),
+			}
+		},
+	)
+	ctx, url := context.TODO(), "http://chat-mt-solo-google.maestro.svc.cluster.local"
+	mtReq := MTRequest{UID: "1245", Text: "hi", SourceLanguage: "en", TargetLanguage: "pt"}
+
+	_, err := maestroClient.MachineTranslateWithQE(ctx, url, (*MTQERequest)(&mtReq))
+	assert.Equal(t, "received 422 response from maestro mt_qe request", err.Error())
+	_, err = maestroClient.PivotedMachineTranslate(ctx, url, &PivotedMTRequest{MTRequest: mtReq, PivotLanguage: "es"})
+	assert.Equal(t, "received 422 response from maestro pivoted_mt request", err.Error())
+	_, err = maestroClient.PivotedMachineTranslateWithQE(ctx, url,
+		&PivotedMTQERequest{MTRequest: mtReq, PivotLanguage: "es"})
+	assert.Equal(t, "received 422 response from maestro pivoted_mt_qe request", err.Error())
+	_, err = maestroClient.PivotedRebuild(ctx, url, &PivotedRebuildRequest{PivotLanguage: "es"})
+	assert.Equal(t, "received 422 response from maestro pivoted_rebuild request", err.Error())
+	assert.Equal(t, []string{"/v1/mt_qe", "/v1/pivoted_mt", "/v1/pivoted_mt_qe", "/v1/pivoted_rebuild"}, paths)
+}
+
+type observation struct {
+	path, host, statusClass string
+	retries                 int
+}
+
+type recordingMetrics struct {
+	observed []observation
+}
+
+func (m *recordingMetrics) ObserveRequest(path, host, statusClass string, retries int, _ time.Duration) {
+	m.observed = append(m.observed, observation{path, host, statusClass, retries})
+}
+
+func TestMetricsObserveRetriesAndStatusClass(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/rebuild"):
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		case requests == 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			_, _ = w.Write([]byte(MTResponseStringForTest))
+		}
+	}))
+	defer server.Close()
+	metrics := &recordingMetrics{}
+	maestroClient := New(log.NewNopLogger(), "user", "pass", DefaultCharsPersSecondTimeout)
+	maestroClient.SetMetrics(metrics)
+
+	_, err := maestroClient.MachineTranslate(context.TODO(), server.URL, &MTRequest{UID: "1", Text: "hi"})
+	assert.Nil(t, err)
+	_, err = maestroClient.Rebuild(context.TODO(), server.URL, &RebuildRequest{UID: "2", Text: "hi"})
+	assert.NotNil(t, err)
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	assert.Equal(t, []observation{
+		{path: machineTranslatePath, host: host, statusClass: "2xx", retries: 1},
+		{path: rebuildPath, host: host, statusClass: "4xx", retries: 0},
+	}, metrics.observed)
+}
+
+func TestStatusClass(t *testing.T) {
+	assert.Equal(t, "error", statusClass(0))
+	assert.Equal(t, "2xx", statusClass(204))
+	assert.Equal(t, "5xx", statusClass(503))
+}
+
+func TestNewRedactsPassword(t *testing.T) {
+	var logged bytes.Buffer
+	assert.Nil(t, New(log.NewLogfmtLogger(&logged), "", "hunter2", DefaultCharsPersSecondTimeout))
+	assert.Contains(t, logged.String(), "basicAuthPass=[redacted]")
+	assert.NotContains(t, logged.String(), "hunter2")
+
+	encoded, _ := json.Marshal(BasicAuth{Username: "user", Password: "hunter2"})
+	assert.NotContains(t, string(encoded), "hunter2")
+}
+
+func TestFileTokenReloadsOnChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	assert.Nil(t, os.WriteFile(path, []byte("first\n"), 0o600))
+	auth, err := NewFileToken(path)
+	assert.Nil(t, err)
+	bearer := func() string {
+		r, _ := http.NewRequest("POST", "http://a.foo", nil)
+		assert.Nil(t, auth.Authenticate(r))
+		return r.Header.Get("Authorization")
+	}
+	assert.Equal(t, "Bearer first", bearer())
+
+	assert.Nil(t, os.WriteFile(path, []byte("second"), 0o600))
+	later := time.Now().Add(time.Second)
+	assert.Nil(t, os.Chtimes(path, later, later))
+	assert.Equal(t, "Bearer second", bearer())
+
+	// a missing or emptied file keeps the last token
+	assert.Nil(t, os.Remove(path))
+	assert.Equal(t, "Bearer second", bearer())
+
+	_, err = NewFileToken(path)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,119 @@
+package maestro
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	retryablehttp "github.com/hashicorp/go-retryablehttp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics receives the timing of every maestro request, retries included
+type Metrics interface {
+	// ObserveRequest records a request to the maestro flow at path on host. statusClass is the
+	// last response status class (2xx, 4xx, 5xx), or error when maestro never answered.
+	ObserveRequest(path, host, statusClass string, retries int, duration time.Duration)
+}
+
+const statusClassError = "error"
+
+// requestDurations are the latency histograms of each maestro flow, by path
+var requestDurations = map[string]*prometheus.HistogramVec{
+	machineTranslatePath:                             timingHistogram(metricTimingMT, "mt"),
+	machineTranslateWithQualityEstimationPath:        timingHistogram(metricTimingMTWithQE, "mt_qe"),
+	pivotedMachineTranslatePath:                      timingHistogram(metricTimingPivotedMT, "pivoted_mt"),
+	pivotedMachineTranslateWithQualityEstimationPath: timingHistogram(metricTimingPivotedMTWithQE, "pivoted_mt_qe"),
+	rebuildPath:        timingHistogram(metricTimingRebuild, "rebuild"),
+	pivotedRebuildPath: timingHistogram(metricTimingPivotedRebuild, "pivoted_rebuild"),
+}
+
+func timingHistogram(name, flow string) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    name,
+		Help:    fmt.Sprintf("Latency of the maestro %v requests, retries included, by status class, retries and host.", flow),
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 20, 40, 80},
+	}, []string{"status_class", "retries", "host"})
+}
+
+var retriesDeniedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "chat2_maestro_retries_denied_total",
+	Help: "Maestro retries not sent because the retry budget ran out.",
+})
+
+var throughputGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "chat2_maestro_throughput_chars_per_sec",
+	Help: "Learned throughput of the maestro requests by host and flow, for the adaptive timeouts.",
+}, []string{"host", "flow"})
+
+func init() {
+	for _, h := range requestDurations {
+		prometheus.MustRegister(h)
+	}
+	prometheus.MustRegister(retriesDeniedCounter, throughputGauge)
+}
+
+// prometheusMetrics is the default Metrics, exported by the prometheus default registry
+type prometheusMetrics struct{}
+
+func (prometheusMetrics) ObserveRequest(path, host, statusClass string, retries int, duration time.Duration) {
+	h, found := requestDurations[path]
+	if !found {
+		return
+	}
+	h.WithLabelValues(statusClass, strconv.Itoa(retries), host).Observe(duration.Seconds())
+}
+
+// SetMetrics replaces the prometheus metrics of the client
+func (c *maestroClient) SetMetrics(metrics Metrics) {
+	c.metrics = metrics
+}
+
+type attemptsKey struct{}
+
+// attempts is filled by the retryablehttp hooks while a request is retried
+type attempts struct {
+	retries    int
+	statusCode int
+}
+
+func withAttempts(ctx context.Context) (context.Context, *attempts) {
+	a := &attempts{}
+	return context.WithValue(ctx, attemptsKey{}, a), a
+}
+
+// countAttempts is the retryablehttp.RequestLogHook, called before each attempt
+func countAttempts(_ retryablehttp.Logger, req *http.Request, attempt int) {
+	if a, ok := req.Context().Value(attemptsKey{}).(*attempts); ok {
+		a.retries = attempt
+		a.statusCode = 0
+	}
+}
+
+// recordStatus is the retryablehttp.ResponseLogHook, called after each attempt that got a response
+func recordStatus(_ retryablehttp.Logger, resp *http.Response) {
+	if resp.Request == nil {
+		return
+	}
+	if a, ok := resp.Request.Context().Value(attemptsKey{}).(*attempts); ok {
+		a.statusCode = resp.StatusCode
+	}
+}
+
+func statusClass(statusCode int) string {
+	if statusCode == 0 {
+		return statusClassError
+	}
+	return fmt.Sprintf("%dxx", statusCode/100)
+}
+
+func hostOf(serviceURL string) string {
+	u, err := url.Parse(serviceURL)
+	if err != nil || u.Host == "" {
+		return serviceURL
+	}
+	return u.Host
+}
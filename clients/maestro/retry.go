@@ -0,0 +1,163 @@
+package maestro
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	retryablehttp "github.com/hashicorp/go-retryablehttp"
+)
+
+// RetryPolicy is how the client retries the maestro requests failing with 429, 5XX or a network error
+type RetryPolicy struct {
+	// MaxAttempts counts the first request too, 1 disables retries
+	MaxAttempts int
+	// retries wait a random time (full jitter) up to BaseBackoff, doubling on every retry up to
+	// MaxBackoff. A Retry-After on 429 and 503 responses is waited for instead, up to MaxBackoff.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// BudgetRatio caps the retries to that ratio of the requests, e.g. 0.1 for 10% more load
+	// on maestro at most. Zero is unlimited.
+	BudgetRatio float64
+}
+
+// DefaultRetryPolicy retries 3 times, without a budget
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: defaultRetryMax + 1,
+	BaseBackoff: defaultRetryDelayMin,
+	MaxBackoff:  defaultRetryDelayMax,
+}
+
+// retryBudgetBurst are the retries allowed before any request paid for them
+const retryBudgetBurst = 10
+
+// retryBudget is a token bucket, every request deposits BudgetRatio tokens and every retry takes one
+type retryBudget struct {
+	ratio float64
+
+	mu     sync.Mutex
+	tokens float64
+}
+
+func newRetryBudget(ratio float64) *retryBudget {
+	if ratio <= 0 {
+		return nil
+	}
+	return &retryBudget{ratio: ratio, tokens: retryBudgetBurst}
+}
+
+func (b *retryBudget) deposit() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += b.ratio
+	if b.tokens > retryBudgetBurst {
+		b.tokens = retryBudgetBurst
+	}
+}
+
+func (b *retryBudget) withdraw() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// SetRetryPolicy replaces the DefaultRetryPolicy of the client
+func (c *maestroClient) SetRetryPolicy(policy RetryPolicy) {
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	c.retryPolicy = policy
+	c.retryBudget = newRetryBudget(policy.BudgetRatio)
+	c.httpClient.RetryMax = policy.MaxAttempts - 1
+	c.httpClient.RetryWaitMin = policy.BaseBackoff
+	c.httpClient.RetryWaitMax = policy.MaxBackoff
+	c.httpClient.CheckRetry = c.checkRetry
+	c.httpClient.Backoff = fullJitterBackoff
+}
+
+// checkRetry is the retryablehttp.CheckRetry, the non retryable responses are returned as they are
+// and the retries are taken from the budget
+func (c *maestroClient) checkRetry(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	retry, checkErr := retryablehttp.DefaultRetryPolicy(ctx, resp, err)
+	if !retry {
+		return false, checkErr
+	}
+	if err == nil && !retryableStatus(resp.StatusCode) {
+		// returned as a StatusError
+		return false, nil
+	}
+	if a, ok := ctx.Value(attemptsKey{}).(*attempts); ok && a.retries >= c.httpClient.RetryMax {
+		// out of attempts, nothing to take from the budget
+		return true, checkErr
+	}
+	if !c.retryBudget.withdraw() {
+		retriesDeniedCounter.Inc()
+		return false, nil
+	}
+	return true, checkErr
+}
+
+// retryableStatus are the responses worth retrying, maestro or its proxies being overloaded or
+// restarting. Other 4XX and 5XX responses would fail again the same way.
+func retryableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// fullJitterBackoff is the retryablehttp.Backoff, a random wait up to base * 2^attempt, or the
+// Retry-After of 429 and 503 responses
+func fullJitterBackoff(base, max time.Duration, attemptNum int, resp *http.Response) time.Duration {
+	if d, ok := retryAfter(resp); ok {
+		if d > max {
+			return max
+		}
+		return d
+	}
+	ceiling := max
+	if attemptNum < 32 && base<<uint(attemptNum) > 0 && base<<uint(attemptNum) < max {
+		ceiling = base << uint(attemptNum)
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil ||
+		(resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return 0, false
+	}
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
@@ -0,0 +1,108 @@
+//go:build unit
+// +build unit
+
+package maestro
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func fastRetries(c *maestroClient, budgetRatio float64) {
+	c.SetRetryPolicy(RetryPolicy{
+		MaxAttempts: 4, BaseBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond, BudgetRatio: budgetRatio,
+	})
+}
+
+func TestRetryHonoursRetryAfter(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte(MTResponseStringForTest))
+	}))
+	defer server.Close()
+	c := New(log.NewNopLogger(), "user", "pass", DefaultCharsPersSecondTimeout)
+	c.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, BaseBackoff: time.Millisecond, MaxBackoff: 5 * time.Second})
+
+	start := time.Now()
+	_, err := c.MachineTranslate(context.TODO(), server.URL, &MTRequest{UID: "1", Text: "hi"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, requests)
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+}
+
+func TestRetrySkipsNonRetryableResponses(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusHTTPVersionNotSupported)
+	}))
+	defer server.Close()
+	c := New(log.NewNopLogger(), "user", "pass", DefaultCharsPersSecondTimeout)
+	fastRetries(c, 0)
+
+	_, err := c.MachineTranslate(context.TODO(), server.URL, &MTRequest{UID: "1", Text: "hi"})
+	var statusErr *StatusError
+	assert.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, http.StatusHTTPVersionNotSupported, statusErr.StatusCode)
+	assert.Equal(t, 1, requests)
+}
+
+func TestRetryBudget(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	c := New(log.NewNopLogger(), "user", "pass", DefaultCharsPersSecondTimeout)
+	fastRetries(c, 0.1)
+
+	for i := 0; i < 20; i++ {
+		_, err := c.MachineTranslate(context.TODO(), server.URL, &MTRequest{UID: "1", Text: "hi"})
+		assert.NotNil(t, err)
+	}
+	// the burst plus a tenth of the requests
+	assert.InDelta(t, 20+retryBudgetBurst+2, requests, 1)
+
+	// without a budget every request is retried
+	requests = 0
+	fastRetries(c, 0)
+	_, _ = c.MachineTranslate(context.TODO(), server.URL, &MTRequest{UID: "1", Text: "hi"})
+	assert.Equal(t, 4, requests)
+}
+
+func TestFullJitterBackoff(t *testing.T) {
+	for attempt := 0; attempt < 40; attempt++ {
+		d := fullJitterBackoff(10*time.Millisecond, time.Second, attempt, nil)
+		ceiling := time.Second
+		if attempt < 6 {
+			ceiling = 10 * time.Millisecond << uint(attempt)
+		}
+		assert.True(t, d >= 0 && d <= ceiling, "attempt %v waited %v", attempt, d)
+	}
+
+	resp := &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}}
+	resp.Header.Set("Retry-After", "3")
+	assert.Equal(t, 3*time.Second, fullJitterBackoff(time.Millisecond, time.Minute, 0, resp))
+	assert.Equal(t, 2*time.Second, fullJitterBackoff(time.Millisecond, 2*time.Second, 0, resp), "capped")
+	resp.Header.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	assert.Equal(t, time.Minute, fullJitterBackoff(time.Millisecond, time.Minute, 0, resp))
+
+	// only 429 and 503 tell when to come back
+	resp.StatusCode = http.StatusBadGateway
+	resp.Header.Set("Retry-After", "3")
+	assert.LessOrEqual(t, fullJitterBackoff(time.Millisecond, time.Minute, 0, resp), time.Millisecond)
+}
@@ -0,0 +1,137 @@
+package maestro
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// AdaptiveTimeouts learn the throughput (characters per second) of every maestro service URL and
+// path, and time requests out once they run well below it. Until MinSamples requests succeeded
+// the static charsPerSecondTimeout is used.
+type AdaptiveTimeouts struct {
+	// Alpha is the weight of the latest request in the throughput EWMA, zero disables them
+	Alpha float64
+	// Deviations are the standard deviations under the mean throughput still waited for,
+	// SafetyFactor multiplies the resulting duration
+	Deviations   float64
+	SafetyFactor float64
+	MinSamples   int
+	// Floor and Ceiling bound the timeouts, a zero Ceiling is unbounded
+	Floor   time.Duration
+	Ceiling time.Duration
+}
+
+func (a AdaptiveTimeouts) enabled() bool {
+	return a.Alpha > 0
+}
+
+// throughput is the EWMA mean and variance of the characters per second of an endpoint
+type throughput struct {
+	samples  int
+	mean     float64
+	variance float64
+}
+
+func (t *throughput) observe(charsPerSecond, alpha float64) {
+	t.samples++
+	if t.samples == 1 {
+		t.mean = charsPerSecond
+		return
+	}
+	diff := charsPerSecond - t.mean
+	incr := alpha * diff
+	t.mean += incr
+	t.variance = (1 - alpha) * (t.variance + diff*incr)
+}
+
+// endpointTimeouts are the throughputs by service URL and path
+type endpointTimeouts struct {
+	config AdaptiveTimeouts
+
+	mu          sync.Mutex
+	throughputs map[string]*throughput
+}
+
+func newEndpointTimeouts(config AdaptiveTimeouts) *endpointTimeouts {
+	return &endpointTimeouts{config: config, throughputs: make(map[string]*throughput)}
+}
+
+// observe records a request of textLen characters taking d. A timed out request only tells
+// its throughput was under textLen/d, which a capped or cold start timeout can put above the
+// mean, so it counts as a penalty of at most half the mean and is skipped without samples.
+func (e *endpointTimeouts) observe(serviceURL, path string, textLen int, d time.Duration, timedOut bool) {
+	if e == nil || textLen == 0 || d <= 0 {
+		return
+	}
+	cps := float64(textLen) / d.Seconds()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	t, found := e.throughputs[serviceURL+"/"+path]
+	if timedOut {
+		if !found || t.samples == 0 {
+			return
+		}
+		if cps > t.mean/2 {
+			cps = t.mean / 2
+		}
+	}
+	if !found {
+		t = &throughput{}
+		e.throughputs[serviceURL+"/"+path] = t
+	}
+	t.observe(cps, e.config.Alpha)
+	throughputGauge.WithLabelValues(hostOf(serviceURL), flowName(path)).Set(t.mean)
+}
+
+// timeout for textLen characters, false until the endpoint has enough samples
+func (e *endpointTimeouts) timeout(serviceURL, path string, textLen int) (time.Duration, bool) {
+	if e == nil {
+		return 0, false
+	}
+	e.mu.Lock()
+	t, found := e.throughputs[serviceURL+"/"+path]
+	var mean, variance float64
+	if found {
+		mean, variance = t.mean, t.variance
+	}
+	enough := found && t.samples >= e.config.MinSamples
+	e.mu.Unlock()
+	if !enough || mean <= 0 {
+		return 0, false
+	}
+
+	// the slow end of the usual throughput, never under a tenth of the mean
+	cps := mean - e.config.Deviations*math.Sqrt(variance)
+	if cps < mean/10 {
+		cps = mean / 10
+	}
+	timeout := time.Duration(float64(textLen) / cps * e.config.SafetyFactor * float64(time.Second))
+	if timeout < e.config.Floor {
+		timeout = e.config.Floor
+	}
+	if e.config.Ceiling > 0 && timeout > e.config.Ceiling {
+		timeout = e.config.Ceiling
+	}
+	return timeout, true
+}
+
+// SetAdaptiveTimeouts learns the request timeouts of each endpoint instead of using
+// the static charsPerSecondTimeout only
+func (c *maestroClient) SetAdaptiveTimeouts(config AdaptiveTimeouts) {
+	if !config.enabled() {
+		c.timeouts = nil
+		return
+	}
+	if config.SafetyFactor <= 0 {
+		config.SafetyFactor = 1
+	}
+	c.timeouts = newEndpointTimeouts(config)
+}
+
+func (c *maestroClient) timeoutFor(serviceURL, path, text string) time.Duration {
+	if timeout, ok := c.timeouts.timeout(serviceURL, path, len(text)); ok {
+		return timeout
+	}
+	return getTimeoutForRequestPayload(path, text, c.charsPerSecondTimeout)
+}
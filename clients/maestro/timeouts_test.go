@@ -0,0 +1,132 @@
+//go:build unit
+// +build unit
+
+package maestro
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThroughputEWMA(t *testing.T) {
+	var tp throughput
+	for i := 0; i < 50; i++ {
+		tp.observe(100, 0.2)
+	}
+	assert.InDelta(t, 100, tp.mean, 0.001)
+	assert.InDelta(t, 0, tp.variance, 0.001)
+
+	for i := 0; i < 50; i++ {
+		tp.observe(float64(50+100*(i%2)), 0.2)
+	}
+	assert.InDelta(t, 100, tp.mean, 10)
+	assert.InDelta(t, 50*50, tp.variance, 500)
+}
+
+func TestAdaptiveTimeout(t *testing.T) {
+	e := newEndpointTimeouts(AdaptiveTimeouts{
+		Alpha: 0.5, Deviations: 1, SafetyFactor: 2, MinSamples: 2, Floor: time.Second, Ceiling: time.Minute,
+	})
+	url := "http://a.foo"
+
+	e.observe(url, machineTranslatePath, 100, time.Second, false)
+	_, ok := e.timeout(url, machineTranslatePath, 1000)
+	assert.False(t, ok, "cold start")
+
+	e.observe(url, machineTranslatePath, 100, time.Second, false)
+	timeout, ok := e.timeout(url, machineTranslatePath, 1000)
+	assert.True(t, ok)
+	// 1000 chars at 100 chars/sec, twice
+	assert.Equal(t, 20*time.Second, timeout)
+	timeout, _ = e.timeout(url, machineTranslatePath, 10)
+	assert.Equal(t, time.Second, timeout, "floor")
+	timeout, _ = e.timeout(url, machineTranslatePath, 100000)
+	assert.Equal(t, time.Minute, timeout, "ceiling")
+
+	// a slow request widens the timeouts
+	e.observe(url, machineTranslatePath, 100, 10*time.Second, false)
+	timeout, _ = e.timeout(url, machineTranslatePath, 1000)
+	assert.Greater(t, int64(timeout), int64(20*time.Second))
+
+	// learned per service URL and path
+	_, ok = e.timeout(url, pivotedMachineTranslatePath, 1000)
+	assert.False(t, ok)
+	_, ok = e.timeout("http://b.foo", machineTranslatePath, 1000)
+	assert.False(t, ok)
+}
+
+func TestTimeoutsDontShrinkTheTimeout(t *testing.T) {
+	e := newEndpointTimeouts(AdaptiveTimeouts{
+		Alpha: 0.5, Deviations: 1, SafetyFactor: 2, MinSamples: 2, Ceiling: 5 * time.Second,
+	})
+	url := "http://a.foo"
+
+	// a timeout without samples says nothing about the usual throughput
+	e.observe(url, machineTranslatePath, 1000, time.Second, true)
+	_, found := e.throughputs[url+"/"+machineTranslatePath]
+	assert.False(t, found)
+
+	e.observe(url, machineTranslatePath, 100, time.Second, false)
+	e.observe(url, machineTranslatePath, 100, time.Second, false)
+	before, ok := e.timeout(url, machineTranslatePath, 100)
+	assert.True(t, ok)
+
+	// long requests timing out at the ceiling ran at under 200 chars/sec, above the mean
+	for i := 0; i < 5; i++ {
+		timeout, _ := e.timeout(url, machineTranslatePath, 1000)
+		assert.Equal(t, 5*time.Second, timeout)
+		e.observe(url, machineTranslatePath, 1000, timeout, true)
+		after, _ := e.timeout(url, machineTranslatePath, 100)
+		assert.GreaterOrEqual(t, int64(after), int64(before))
+		before = after
+	}
+}
+
+func TestClientLearnsTimeouts(t *testing.T) {
+	var slow int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		if atomic.LoadInt32(&slow) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		_, _ = w.Write([]byte(MTResponseStringForTest))
+	}))
+	defer server.Close()
+	c := New(log.NewNopLogger(), "user", "pass", DefaultCharsPersSecondTimeout)
+	c.SetRetryPolicy(RetryPolicy{MaxAttempts: 1})
+	c.SetAdaptiveTimeouts(AdaptiveTimeouts{
+		Alpha: 0.5, Deviations: 1, SafetyFactor: 2, MinSamples: 1, Floor: 100 * time.Millisecond,
+	})
+	req := &MTRequest{UID: "1", Text: strings.Repeat("a", 100)}
+
+	assert.Equal(t, MinimumRequestTimeout, c.timeoutFor(server.URL, machineTranslatePath, req.Text))
+	_, err := c.MachineTranslate(context.TODO(), server.URL, req)
+	assert.Nil(t, err)
+	learned := c.timeoutFor(server.URL, machineTranslatePath, req.Text)
+	assert.Less(t, int64(learned), int64(time.Second))
+
+	// way slower than usual, it times out long before the static timeout
+	key := server.URL + "/" + machineTranslatePath
+	before := c.timeouts.throughputs[key].mean
+	atomic.StoreInt32(&slow, 1)
+	start := time.Now()
+	_, err = c.MachineTranslate(context.TODO(), server.URL, req)
+	assert.NotNil(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(2*time.Second))
+	// and the timeout lowers the learned throughput
+	assert.Less(t, c.timeouts.throughputs[key].mean, before)
+}
@@ -0,0 +1,27 @@
+package maestro
+
+import "github.com/msf/cachingproxy/model/maestro"
+
+// the request and response types of each maestro flow, and the values they carry
+type (
+	MTRequest              = maestro.MTRequest
+	MTResponse             = maestro.MTResponse
+	MTQERequest            = maestro.MTQERequest
+	MTQEResponse           = maestro.MTQEResponse
+	PivotedMTRequest       = maestro.PivotedMTRequest
+	PivotedMTResponse      = maestro.PivotedMTResponse
+	PivotedMTQERequest     = maestro.PivotedMTQERequest
+	PivotedMTQEResponse    = maestro.PivotedMTQEResponse
+	RebuildRequest         = maestro.RebuildRequest
+	RebuildResponse        = maestro.RebuildResponse
+	PivotedRebuildRequest  = maestro.PivotedRebuildRequest
+	PivotedRebuildResponse = maestro.PivotedRebuildResponse
+
+	TranslatedData       = maestro.TranslatedData
+	Nugget               = maestro.Nugget
+	MetaAttributes       = maestro.MetaAttributes
+	Annotations          = maestro.Annotations
+	Annotation           = maestro.Annotation
+	MarkupTag            = maestro.MarkupTag
+	HumanEditionMetadata = maestro.HumanEditionMetadata
+)
@@ -3,7 +3,7 @@ package cmd
 import (
 	"compress/gzip"
 	"fmt"
-
+	"net/http"
 	"strings"
 
 	"github.com/labstack/echo-contrib/prometheus"
@@ -11,7 +11,9 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/msf/cachingproxy/handler/mtcache"
 	"github.com/msf/cachingproxy/handler/mtproxy"
+	"github.com/msf/cachingproxy/model"
 	"github.com/msf/cachingproxy/server"
+	prom "github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -45,19 +47,29 @@ var echoCmd = &cobra.Command{
 		log.WithFields(logrus.Fields{
 			"cacheMB":    cacheMB,
 			"cacheTTL":   cacheTTL,
+			"softTTL":    cacheSoftTTL,
+			"cacheDir":   cacheDir,
+			"snapshot":   cacheSnapshot,
 			"ListenPort": EchoPort,
 		}).Print("Echo Starting now")
 
+		proxyCfg, err := proxyConfig()
+		if err != nil {
+			log.Fatal("invalid config: ", err)
+		}
+
 		if err := runEcho(
 			EchoPort,
 			mtcache.Config{
-				MaxSizeMB: int64(cacheMB),
-				MaxTTL:    cacheTTL,
-			},
-			map[mtproxy.RoutingKey]string{
-				{SourceLang: "en", TargetLang: "pt"}: "bananas.foo",
-				{}:                                   "bar.foo",
+				MaxSizeMB:      int64(cacheMB),
+				MaxTTL:         cacheTTL,
+				SoftTTL:        cacheSoftTTL,
+				DiskDir:        cacheDir,
+				DiskMaxEntries: cacheDiskMax,
+				SnapshotPath:   cacheSnapshot,
 			},
+			proxyCfg,
+			requestLimits(),
 		); err != nil {
 			log.Error("ServeHTTP error", err)
 		}
@@ -65,7 +77,7 @@ var echoCmd = &cobra.Command{
 }
 
 func runEcho(
-	listenPort int16, cacheCfg mtcache.Config, routes map[mtproxy.RoutingKey]string,
+	listenPort int16, cacheCfg mtcache.Config, proxyCfg mtproxy.Config, limits model.RequestLimits,
 ) error {
 	e := echo.New()
 	p := prometheus.NewPrometheus("echo", nil)
@@ -78,12 +90,26 @@ func runEcho(
 		},
 	}))
 
+	srv, err := server.NewEchoServer(cacheCfg, proxyCfg, limits)
+	if err != nil {
+		return err
+	}
+	if err := srv.RegisterMetrics(prom.DefaultRegisterer); err != nil {
+		return err
+	}
+
 	log.WithFields(logrus.Fields{
 		"cacheConfig": cacheCfg,
-		"routes":      routes,
+		"routes":      proxyCfg.Routes,
 	}).Info(("Echo is ready!"))
 
 	e.GET("/echo/:id/:cnt", server.EchoMessage)
 	e.GET("/ping", server.EchoPing)
-	return e.Start(fmt.Sprintf(":%v", listenPort))
+	e.POST("/v1/machine_translate", srv.MachineTranslate)
+
+	// persist the cache only once the in-flight requests are done with it
+	return serveUntilSignal(&http.Server{
+		Addr:    fmt.Sprintf(":%v", listenPort),
+		Handler: e,
+	}, shutdownTimeout, srv.Shutdown)
 }
@@ -1,13 +1,20 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"strconv"
 
 	"github.com/gin-contrib/gzip"
 	"github.com/gin-gonic/gin"
 	"github.com/msf/cachingproxy/handler/mtcache"
 	"github.com/msf/cachingproxy/handler/mtproxy"
+	"github.com/msf/cachingproxy/model"
 	"github.com/msf/cachingproxy/server"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	ginlogrus "github.com/toorop/gin-logrus"
@@ -15,12 +22,16 @@ import (
 
 var (
 	GinPort     int16
+	AdminPort   int16
+	AdminHost   string
 	ReleaseMode bool
 )
 
 func init() {
 	rootCmd.AddCommand(ginCmd)
 	ginCmd.Flags().Int16Var(&GinPort, "ginPort", 4321, "gin server listening port")
+	ginCmd.Flags().Int16Var(&AdminPort, "adminPort", 0, "admin server listening port, disabled by default (0) as the admin API is unauthenticated")
+	ginCmd.Flags().StringVar(&AdminHost, "adminHost", "127.0.0.1", "admin server listening address, only reachable from localhost by default")
 	ginCmd.Flags().BoolVar(&ReleaseMode, "release", false, "release mode")
 }
 
@@ -32,19 +43,29 @@ var ginCmd = &cobra.Command{
 		log.WithFields(logrus.Fields{
 			"cacheMB":    cacheMB,
 			"cacheTTL":   cacheTTL,
+			"softTTL":    cacheSoftTTL,
+			"cacheDir":   cacheDir,
+			"snapshot":   cacheSnapshot,
 			"ListenPort": GinPort,
 		}).Print("Gin Starting now")
 
+		proxyCfg, err := proxyConfig()
+		if err != nil {
+			log.Fatal("invalid config: ", err)
+		}
+
 		if err := runGin(
 			GinPort,
 			mtcache.Config{
-				MaxSizeMB: int64(cacheMB),
-				MaxTTL:    cacheTTL,
-			},
-			map[mtproxy.RoutingKey]string{
-				{SourceLang: "en", TargetLang: "pt"}: "bananas.foo",
-				{}:                                   "bar.foo",
+				MaxSizeMB:      int64(cacheMB),
+				MaxTTL:         cacheTTL,
+				SoftTTL:        cacheSoftTTL,
+				DiskDir:        cacheDir,
+				DiskMaxEntries: cacheDiskMax,
+				SnapshotPath:   cacheSnapshot,
 			},
+			proxyCfg,
+			requestLimits(),
 		); err != nil {
 			log.Error("ServeHTTP error", err)
 		}
@@ -53,28 +74,73 @@ var ginCmd = &cobra.Command{
 }
 
 func runGin(
-	listenPort int16, cacheCfg mtcache.Config, routes map[mtproxy.RoutingKey]string,
+	listenPort int16, cacheCfg mtcache.Config, proxyCfg mtproxy.Config, limits model.RequestLimits,
 ) error {
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
 	r.Use(
 		ginlogrus.Logger(log),
 		gin.Recovery(),
+		server.GinMetrics(),
 	)
 	r.Use(gzip.Gzip(gzip.BestSpeed, gzip.WithExcludedPaths([]string{"/metrics"})))
 
 	// TODO: cmdline args for this
 	srv, err := server.NewGinServer(
 		cacheCfg,
-		routes,
+		proxyCfg,
+		limits,
 	)
 	if err != nil {
 		return err
 	}
+	if err := srv.RegisterMetrics(prometheus.DefaultRegisterer); err != nil {
+		return err
+	}
 
+	var admin *http.Server
+	if AdminPort > 0 {
+		admin = runGinAdmin(AdminHost, AdminPort, srv)
+	}
+
+	r.GET("/metrics", server.GinPrometheus())
 	r.GET("/ping", srv.Ping)
 	r.GET("/echo/:id/:cnt", srv.Message)
 	r.POST("/v1/machine_translate", srv.MachineTranslate)
 
-	return r.Run(fmt.Sprintf(":%v", listenPort))
+	httpSrv := &http.Server{
+		Addr:    fmt.Sprintf(":%v", listenPort),
+		Handler: r,
+	}
+	// persist the cache only once the in-flight requests are done with it
+	return serveUntilSignal(httpSrv, shutdownTimeout, func(ctx context.Context) error {
+		if admin != nil {
+			admin.Shutdown(ctx)
+		}
+		return srv.Shutdown(ctx)
+	})
+}
+
+// runGinAdmin serves the cache admin API on its own listener, to keep it internal
+func runGinAdmin(listenHost string, listenPort int16, srv *server.GinServer) *http.Server {
+	r := gin.New()
+	r.Use(
+		ginlogrus.Logger(log),
+		gin.Recovery(),
+	)
+	r.GET("/admin/cache/stats", srv.CacheStats)
+	r.GET("/admin/cache/segment", srv.CacheLookup)
+	r.DELETE("/admin/cache/segment", srv.CacheDelete)
+	r.DELETE("/admin/cache/languages/:source_lang/:target_lang", srv.CachePurge)
+
+	admin := &http.Server{
+		Addr:    net.JoinHostPort(listenHost, strconv.Itoa(int(listenPort))),
+		Handler: r,
+	}
+	go func() {
+		if err := admin.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Error("admin ServeHTTP error", err)
+		}
+	}()
+	return admin
 }
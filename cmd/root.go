@@ -1,10 +1,14 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"time"
 
+	"github.com/msf/cachingproxy/clients/maestro"
+	"github.com/msf/cachingproxy/handler/mtproxy"
+	"github.com/msf/cachingproxy/model"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
@@ -12,9 +16,53 @@ import (
 )
 
 var (
-	cfgFile  string
-	cacheMB  int
-	cacheTTL time.Duration
+	cfgFile         string
+	cacheMB         int
+	cacheTTL        time.Duration
+	cacheSoftTTL    time.Duration
+	cacheDir        string
+	cacheDiskMax    int
+	cacheSnapshot   string
+	shutdownTimeout time.Duration
+
+	maestroUsername       string
+	maestroPassword       string
+	maestroCharsPerSecond float64
+	negativeRouteTTL      time.Duration
+	negativeSegmentTTL    time.Duration
+	maxBatchSegments      int
+	maxBatchChars         int
+	maxRouteConcurrency   int
+	breakerFailures       int
+	breakerCooldown       time.Duration
+	breakerProbes         int
+	breakerCacheOnly      bool
+	healthCheckPath       string
+	healthCheckInterval   time.Duration
+	healthCheckTimeout    time.Duration
+	healthCheckThreshold  int
+	outlierErrors         int
+	outlierEjection       time.Duration
+	outlierMaxEjection    time.Duration
+	hedgeDelay            time.Duration
+	hedgePercentile       float64
+	hedgeMinSamples       int
+	hedgeMinDelay         time.Duration
+	retryMaxAttempts      int
+	retryBaseBackoff      time.Duration
+	retryMaxBackoff       time.Duration
+	retryBudget           float64
+	timeoutAlpha          float64
+	timeoutDeviations     float64
+	timeoutSafetyFactor   float64
+	timeoutMinSamples     int
+	timeoutFloor          time.Duration
+	timeoutCeiling        time.Duration
+
+	allowPassthrough bool
+	maxSegments      int
+	maxSegmentChars  int
+	maxTotalChars    int
 
 	// Logger
 	log *logrus.Logger
@@ -43,6 +91,88 @@ func init() {
 	rootCmd.PersistentFlags().IntVar(&cacheMB, "cacheMB", 512, "in memory cache size in MB")
 	rootCmd.PersistentFlags().DurationVar(
 		&cacheTTL, "cacheTTL", 72*time.Hour, "cache entries time to live")
+	rootCmd.PersistentFlags().DurationVar(
+		&cacheSoftTTL, "cacheSoftTTL", 0, "age after which cache entries are refreshed in the background, 0 disables it")
+	rootCmd.PersistentFlags().StringVar(
+		&cacheDir, "cacheDir", "", "directory of the persistent on-disk cache (default is memory only)")
+	rootCmd.PersistentFlags().IntVar(&cacheDiskMax, "cacheDiskMaxEntries", 5_000_000,
+		"max entries of the on-disk cache, the ones expiring first are evicted, 0 is unlimited")
+	rootCmd.PersistentFlags().StringVar(
+		&cacheSnapshot, "cacheSnapshot", "", "cache snapshot file, loaded on startup and written on SIGTERM")
+	rootCmd.PersistentFlags().DurationVar(&shutdownTimeout, "shutdownTimeout", 25*time.Second,
+		"on shutdown, the time to drain in-flight requests (up to 2/3 of it) and then flush the cache, "+
+			"keep it under the SIGTERM grace period")
+	rootCmd.PersistentFlags().StringVar(&maestroUsername, "maestroUser", "", "maestro basic auth username, for the routes without their own auth")
+	rootCmd.PersistentFlags().StringVar(&maestroPassword, "maestroPass", "", "maestro basic auth password, for the routes without their own auth")
+	rootCmd.PersistentFlags().Float64Var(&maestroCharsPerSecond, "maestroCharsPerSecond",
+		maestro.DefaultCharsPersSecondTimeout, "lower bound of maestro throughput, used for request timeouts")
+	rootCmd.PersistentFlags().DurationVar(&negativeRouteTTL, "negativeRouteTTL", 5*time.Second,
+		"how long a failing maestro route fails fast without being called, 0 disables it")
+	rootCmd.PersistentFlags().DurationVar(&negativeSegmentTTL, "negativeSegmentTTL", time.Minute,
+		"how long a segment rejected by maestro (4XX) fails fast without being sent, 0 disables it")
+	rootCmd.PersistentFlags().IntVar(&maxBatchSegments, "maxBatchSegments", 50,
+		"max segments per maestro request, bigger requests are split, 0 is unlimited")
+	rootCmd.PersistentFlags().IntVar(&maxBatchChars, "maxBatchChars", 5000,
+		"max characters per maestro request, bigger requests are split, 0 is unlimited")
+	rootCmd.PersistentFlags().IntVar(&maxRouteConcurrency, "maxRouteConcurrency", 8,
+		"max concurrent maestro requests of each route, and batches of each request, 0 is unlimited")
+	rootCmd.PersistentFlags().IntVar(&breakerFailures, "breakerFailures", 5,
+		"consecutive failures opening the circuit breaker of a maestro host, 0 disables it")
+	rootCmd.PersistentFlags().DurationVar(&breakerCooldown, "breakerCooldown", 30*time.Second,
+		"how long an open circuit breaker waits before probing the maestro host again")
+	rootCmd.PersistentFlags().IntVar(&breakerProbes, "breakerProbes", 1,
+		"successful probes closing a half open circuit breaker")
+	rootCmd.PersistentFlags().BoolVar(&breakerCacheOnly, "breakerCacheOnly", false,
+		"answer from the cache alone while a circuit breaker is open, instead of failing")
+	rootCmd.PersistentFlags().StringVar(&healthCheckPath, "healthCheckPath", "",
+		"path requested on every maestro host to check its health, empty disables the checks")
+	rootCmd.PersistentFlags().DurationVar(&healthCheckInterval, "healthCheckInterval", 10*time.Second,
+		"time between the health checks of each maestro host")
+	rootCmd.PersistentFlags().DurationVar(&healthCheckTimeout, "healthCheckTimeout", 2*time.Second,
+		"health check request timeout")
+	rootCmd.PersistentFlags().IntVar(&healthCheckThreshold, "healthCheckThreshold", 2,
+		"consecutive health checks marking a maestro host unhealthy, or healthy again")
+	rootCmd.PersistentFlags().IntVar(&outlierErrors, "outlierErrors", 5,
+		"consecutive failures ejecting a maestro host from its routes, 0 disables it")
+	rootCmd.PersistentFlags().DurationVar(&outlierEjection, "outlierEjection", 30*time.Second,
+		"first ejection time of a maestro host, it grows with each ejection in a row")
+	rootCmd.PersistentFlags().DurationVar(&outlierMaxEjection, "outlierMaxEjection", 5*time.Minute,
+		"max ejection time of a maestro host")
+	rootCmd.PersistentFlags().DurationVar(&hedgeDelay, "hedgeDelay", 0,
+		"send a second request to another endpoint when maestro hasn't answered by then, 0 disables it")
+	rootCmd.PersistentFlags().Float64Var(&hedgePercentile, "hedgePercentile", 0,
+		"hedge after this percentile of the maestro host latencies (e.g. 0.95) instead of hedgeDelay, 0 disables it")
+	rootCmd.PersistentFlags().IntVar(&hedgeMinSamples, "hedgeMinSamples", 20,
+		"latencies observed on a maestro host before hedgePercentile is used")
+	rootCmd.PersistentFlags().DurationVar(&hedgeMinDelay, "hedgeMinDelay", 100*time.Millisecond,
+		"min hedge delay when using hedgePercentile")
+	rootCmd.PersistentFlags().IntVar(&retryMaxAttempts, "retryMaxAttempts", 4,
+		"maestro attempts per request on 429, 5XX and network errors, 1 disables retries")
+	rootCmd.PersistentFlags().DurationVar(&retryBaseBackoff, "retryBaseBackoff", 50*time.Millisecond,
+		"first retry max wait, it doubles on every retry (full jitter)")
+	rootCmd.PersistentFlags().DurationVar(&retryMaxBackoff, "retryMaxBackoff", 5*time.Second,
+		"max wait between retries, Retry-After included")
+	rootCmd.PersistentFlags().Float64Var(&retryBudget, "retryBudget", 0.2,
+		"max retries as a ratio of the requests to maestro, 0 is unlimited")
+	rootCmd.PersistentFlags().Float64Var(&timeoutAlpha, "timeoutAlpha", 0.1,
+		"weight of the latest request in the learned maestro throughput, 0 disables adaptive timeouts")
+	rootCmd.PersistentFlags().Float64Var(&timeoutDeviations, "timeoutDeviations", 3,
+		"standard deviations under the learned throughput still waited for")
+	rootCmd.PersistentFlags().Float64Var(&timeoutSafetyFactor, "timeoutSafetyFactor", 2,
+		"multiplier of the learned timeouts")
+	rootCmd.PersistentFlags().IntVar(&timeoutMinSamples, "timeoutMinSamples", 20,
+		"requests to a maestro endpoint before its learned timeout replaces maestroCharsPerSecond")
+	rootCmd.PersistentFlags().DurationVar(&timeoutFloor, "timeoutFloor", 2*time.Second, "min learned timeout")
+	rootCmd.PersistentFlags().DurationVar(&timeoutCeiling, "timeoutCeiling", 2*time.Minute,
+		"max learned timeout, 0 is unbounded")
+
+	rootCmd.PersistentFlags().BoolVar(&allowPassthrough, "allowPassthrough", false,
+		"accept requests with the same source and target language, returning the segments as is")
+	rootCmd.PersistentFlags().IntVar(&maxSegments, "maxSegments", 1000, "max segments per request, 0 is unlimited")
+	rootCmd.PersistentFlags().IntVar(&maxSegmentChars, "maxSegmentChars", 10_000,
+		"max characters per segment, 0 is unlimited")
+	rootCmd.PersistentFlags().IntVar(&maxTotalChars, "maxTotalChars", 100_000,
+		"max characters per request, 0 is unlimited")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -57,12 +187,100 @@ func initConfig() {
 	} else {
 		viper.SetConfigType("yaml")
 		viper.SetConfigName("mtproxy.yaml")
+		viper.AddConfigPath(".")
 	}
 
+	viper.SetEnvPrefix("mtproxy")
 	viper.AutomaticEnv() // read in environment variables that match
 
 	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
+	err := viper.ReadInConfig()
+	if err == nil {
 		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
+	} else if cfgFile != "" {
+		cobra.CheckErr(fmt.Errorf("reading config file %v: %w", cfgFile, err))
+	}
+}
+
+// proxyConfig builds the mtproxy.Config from the flags and the `routes:` config section.
+// The MTPROXY_ROUTES env variable overrides the config file routes, given as a json list.
+func proxyConfig() (mtproxy.Config, error) {
+	var routes []mtproxy.RouteConfig
+	if raw, ok := viper.Get("routes").(string); ok {
+		// decoded like the config file, so durations may be given as "200ms"
+		var parsed interface{}
+		if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+			return mtproxy.Config{}, fmt.Errorf("parsing MTPROXY_ROUTES: %w", err)
+		}
+		env := viper.New()
+		env.Set("routes", parsed)
+		if err := env.UnmarshalKey("routes", &routes); err != nil {
+			return mtproxy.Config{}, fmt.Errorf("parsing MTPROXY_ROUTES: %w", err)
+		}
+	} else if err := viper.UnmarshalKey("routes", &routes); err != nil {
+		return mtproxy.Config{}, fmt.Errorf("parsing routes config: %w", err)
+	}
+
+	routingMap, err := mtproxy.NewRoutingMap(routes)
+	if err != nil {
+		return mtproxy.Config{}, err
+	}
+	return mtproxy.Config{
+		Routes:                routingMap,
+		MaestroUsername:       maestroUsername,
+		MaestroPassword:       maestro.Secret(maestroPassword),
+		CharsPerSecondTimeout: maestroCharsPerSecond,
+		NegativeRouteTTL:      negativeRouteTTL,
+		NegativeSegmentTTL:    negativeSegmentTTL,
+		MaxBatchSegments:      maxBatchSegments,
+		MaxBatchChars:         maxBatchChars,
+		MaxRouteConcurrency:   maxRouteConcurrency,
+		Breaker: mtproxy.BreakerConfig{
+			FailureThreshold: breakerFailures,
+			Cooldown:         breakerCooldown,
+			SuccessThreshold: breakerProbes,
+			CacheOnly:        breakerCacheOnly,
+		},
+		Outlier: mtproxy.OutlierConfig{
+			ConsecutiveErrors: outlierErrors,
+			BaseEjectionTime:  outlierEjection,
+			MaxEjectionTime:   outlierMaxEjection,
+		},
+		HealthCheck: mtproxy.HealthCheckConfig{
+			Path:               healthCheckPath,
+			Interval:           healthCheckInterval,
+			Timeout:            healthCheckTimeout,
+			UnhealthyThreshold: healthCheckThreshold,
+			HealthyThreshold:   healthCheckThreshold,
+		},
+		Retry: maestro.RetryPolicy{
+			MaxAttempts: retryMaxAttempts,
+			BaseBackoff: retryBaseBackoff,
+			MaxBackoff:  retryMaxBackoff,
+			BudgetRatio: retryBudget,
+		},
+		Timeouts: maestro.AdaptiveTimeouts{
+			Alpha:        timeoutAlpha,
+			Deviations:   timeoutDeviations,
+			SafetyFactor: timeoutSafetyFactor,
+			MinSamples:   timeoutMinSamples,
+			Floor:        timeoutFloor,
+			Ceiling:      timeoutCeiling,
+		},
+		Hedge: mtproxy.HedgeConfig{
+			Delay:      hedgeDelay,
+			Percentile: hedgePercentile,
+			MinSamples: hedgeMinSamples,
+			MinDelay:   hedgeMinDelay,
+		},
+	}, nil
+}
+
+func requestLimits() model.RequestLimits {
+	return model.RequestLimits{
+		AllowPassthrough: allowPassthrough,
+		MaxSegments:      maxSegments,
+		MaxSegmentChars:  maxSegmentChars,
+		MaxTotalChars:    maxTotalChars,
 	}
 }
@@ -0,0 +1,32 @@
+//go:build unit
+// +build unit
+
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/msf/cachingproxy/handler/mtproxy"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyConfigFromEnvRoutes(t *testing.T) {
+	t.Cleanup(viper.Reset)
+	// what MTPROXY_ROUTES looks like to viper
+	viper.Set("routes", `[{"target_lang": "ja", "host": "ja.bananas.foo",
+		"retry": {"max_attempts": 2, "base_backoff": "200ms", "max_backoff": "2s"},
+		"hedge": {"delay": "150ms"}}]`)
+
+	config, err := proxyConfig()
+	assert.Nil(t, err)
+	route := config.Routes[mtproxy.RoutingKey{TargetLang: "ja"}]
+	assert.Equal(t, &mtproxy.RetryConfig{MaxAttempts: 2, BaseBackoff: 200 * time.Millisecond, MaxBackoff: 2 * time.Second},
+		route.Retry)
+	assert.Equal(t, &mtproxy.HedgeConfig{Delay: 150 * time.Millisecond}, route.Hedge)
+
+	viper.Set("routes", `[{"host": "ja.bananas.foo", "retry": {"base_backoff": "soon"}}]`)
+	_, err = proxyConfig()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// serveUntilSignal serves srv until SIGTERM/Interrupt, then stops accepting connections
+// and gives the in-flight requests up to 2/3 of shutdownTimeout to finish. Requests still
+// running after that have their context cancelled. onShutdown runs last, with whatever is left
+// of shutdownTimeout, and also when srv fails to serve so nothing is left unflushed.
+func serveUntilSignal(
+	srv *http.Server, shutdownTimeout time.Duration, onShutdown func(context.Context) error,
+) error {
+	// parent of every request context, cancelled when draining times out
+	baseCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv.BaseContext = func(net.Listener) context.Context { return baseCtx }
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(sig)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-served:
+		return runOnShutdown(onShutdown, time.Now().Add(shutdownTimeout), err)
+	case s := <-sig:
+		log.WithField("signal", s).Info("shutting down, draining connections")
+	}
+
+	deadline := time.Now().Add(shutdownTimeout)
+	ctx, cancelDrain := context.WithTimeout(context.Background(), shutdownTimeout*2/3)
+	defer cancelDrain()
+	var err error
+	if err = srv.Shutdown(ctx); err != nil {
+		log.Warn("drain timed out, cancelling in-flight requests: ", err)
+		cancel()
+		err = srv.Close()
+	}
+	if er := <-served; !errors.Is(er, http.ErrServerClosed) && err == nil {
+		err = er
+	}
+	return runOnShutdown(onShutdown, deadline, err)
+}
+
+// runOnShutdown runs onShutdown, if any, until deadline. err is returned first, when set.
+func runOnShutdown(onShutdown func(context.Context) error, deadline time.Time, err error) error {
+	if onShutdown == nil {
+		return err
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if er := onShutdown(ctx); er != nil && err == nil {
+		err = er
+	}
+	return err
+}
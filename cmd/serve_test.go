@@ -0,0 +1,29 @@
+//go:build unit
+// +build unit
+
+package cmd
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeUntilSignalShutsDownWhenServingFails(t *testing.T) {
+	// the port is taken, so serving fails right away
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer taken.Close()
+
+	var deadline time.Time
+	err = serveUntilSignal(&http.Server{Addr: taken.Addr().String()}, time.Minute, func(ctx context.Context) error {
+		deadline, _ = ctx.Deadline()
+		return nil
+	})
+	assert.NotNil(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, 5*time.Second)
+}
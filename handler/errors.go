@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/msf/cachingproxy/model"
+)
+
+// Error codes of the MT failures, stable for clients to act on
+const (
+	CodeValidation      = "validation_failed"
+	CodeNoRoute         = "no_route"
+	CodeUpstreamTimeout = "upstream_timeout"
+	CodeUpstreamFailed  = "upstream_failed"
+	// the engine is known to be failing, it wasn't called
+	CodeUpstreamUnavailable = "upstream_unavailable"
+	CodeCacheFailed         = "cache_failed"
+	// the request ran out of time or its caller went away, outside of the engine call
+	CodeTimeout   = "request_timeout"
+	CodeCancelled = "request_cancelled"
+	CodeInternal  = "internal_error"
+)
+
+// ErrUpstreamUnavailable is the UpstreamError.Err of the requests not sent to a failing engine
+var ErrUpstreamUnavailable = errors.New("upstream unavailable, circuit breaker open")
+
+// ErrorCode classifies err into one of the Code* constants
+func ErrorCode(err error) string {
+	var (
+		validation model.ValidationErrors
+		noRoute    *NoRouteError
+		upstream   *UpstreamError
+		cacheErr   *CacheError
+	)
+	switch {
+	case errors.As(err, &validation):
+		return CodeValidation
+	case errors.As(err, &noRoute):
+		return CodeNoRoute
+	case errors.Is(err, ErrUpstreamUnavailable):
+		return CodeUpstreamUnavailable
+	case errors.Is(err, context.Canceled):
+		// the caller went away, even if it was waiting on the engine at the time
+		return CodeCancelled
+	case errors.As(err, &upstream) && upstream.Timeout():
+		return CodeUpstreamTimeout
+	case errors.As(err, &upstream):
+		return CodeUpstreamFailed
+	case errors.As(err, &cacheErr):
+		return CodeCacheFailed
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeTimeout
+	}
+	return CodeInternal
+}
+
+// NoRouteError is returned when no MT engine is configured for a request
+type NoRouteError struct {
+	// Route describes the routing key that didn't match
+	Route string
+}
+
+func (e *NoRouteError) Error() string {
+	return "no route for " + e.Route
+}
+
+// UpstreamError is a failed call to an MT engine
+type UpstreamError struct {
+	Host string
+	// StatusCode of the engine response, 0 if there was no response
+	StatusCode int
+	// Segment is set when the engine rejected the segments sent, not the request as a whole:
+	// sending them again fails the same way, the other segments may still be translated
+	Segment bool
+	Err     error
+}
+
+func (e *UpstreamError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("upstream %v replied %v: %v", e.Host, e.StatusCode, e.Err)
+	}
+	return fmt.Sprintf("upstream %v failed: %v", e.Host, e.Err)
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout is true when the engine didn't reply in time
+func (e *UpstreamError) Timeout() bool {
+	var netErr net.Error
+	return errors.Is(e.Err, context.DeadlineExceeded) ||
+		(errors.As(e.Err, &netErr) && netErr.Timeout())
+}
+
+// IsSegmentFailure is true when err is an UpstreamError caused by the segments sent
+func IsSegmentFailure(err error) bool {
+	var upstream *UpstreamError
+	return errors.As(err, &upstream) && upstream.Segment
+}
+
+// CacheError is a failure of the local cache
+type CacheError struct {
+	// Op is the failed operation, e.g. fetch
+	Op  string
+	Err error
+}
+
+func (e *CacheError) Error() string {
+	return fmt.Sprintf("cache %v failed: %v", e.Op, e.Err)
+}
+
+func (e *CacheError) Unwrap() error {
+	return e.Err
+}
@@ -1,8 +1,13 @@
 // Package handler implements application main business logic
 package handler
 
-import "github.com/msf/cachingproxy/model"
+import (
+	"context"
 
+	"github.com/msf/cachingproxy/model"
+)
+
+// MachineTranslationHandler translates requests, giving up once ctx is done
 type MachineTranslationHandler interface {
-	Handle(*model.MachineTranslationRequest) (*model.MachineTranslationResponse, error)
+	Handle(context.Context, *model.MachineTranslationRequest) (*model.MachineTranslationResponse, error)
 }
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"context"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/msf/cachingproxy/handler"
+	"github.com/msf/cachingproxy/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// batchLimits bound the segments of each remoteTranslator request, zero is unlimited
+type batchLimits struct {
+	maxSegments int
+	maxChars    int
+}
+
+// split cuts b into consecutive batches within the limits, keeping the segments order.
+// A segment longer than maxChars goes alone in its batch.
+func (l batchLimits) split(b leadBatch) []leadBatch {
+	var batches []leadBatch
+	start, chars := 0, 0
+	for i, s := range b.sources {
+		n := utf8.RuneCountInString(s)
+		full := (l.maxSegments > 0 && i-start >= l.maxSegments) ||
+			(l.maxChars > 0 && i > start && chars+n > l.maxChars)
+		if full {
+			batches = append(batches, b.slice(start, i))
+			start, chars = i, 0
+		}
+		chars += n
+	}
+	if start < len(b.sources) {
+		batches = append(batches, b.slice(start, len(b.sources)))
+	}
+	return batches
+}
+
+func (b leadBatch) slice(start, end int) leadBatch {
+	return leadBatch{
+		keys:    b.keys[start:end],
+		sources: b.sources[start:end],
+		calls:   b.calls[start:end],
+	}
+}
+
+// translateBatches translates lead in batches, up to maxConcurrentBatches at once, and finishes
+// the calls of each batch as soon as it is translated. It returns once every batch is done.
+func (m *cachingMTHandler) translateBatches(
+	ctx context.Context, id string, metadata model.MTRequestMetadata, lead leadBatch,
+) {
+	batches := m.batchLimits.split(lead)
+	concurrent := m.maxConcurrentBatches
+	if concurrent <= 0 || concurrent > len(batches) {
+		concurrent = len(batches)
+	}
+	slots := make(chan struct{}, concurrent)
+	var wg sync.WaitGroup
+	for _, b := range batches {
+		b := b
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			defer func() {
+				// translateRemote already failed the calls of the batch
+				if r := recover(); r != nil {
+					log.Error("remoteTranslator panic", r)
+				}
+			}()
+			m.translateBatch(ctx, id, metadata, b)
+		}()
+	}
+	wg.Wait()
+}
+
+// translateBatch translates b and finishes its calls. When the remoteTranslator rejects some
+// segment of b, b is bisected until the culprit is alone, so the other segments are translated.
+func (m *cachingMTHandler) translateBatch(
+	ctx context.Context, id string, metadata model.MTRequestMetadata, b leadBatch,
+) {
+	var bisect bool
+	m.translateRemote(ctx, id, metadata, b.sources, func(targets []model.TargetSegment, err error) {
+		if err != nil && len(b.keys) > 1 && handler.IsSegmentFailure(err) && ctx.Err() == nil {
+			bisect = true
+			return
+		}
+		if err != nil && ctx.Err() != nil {
+			// failed because the leading request is done, not the remoteTranslator
+			err = &leaderGoneError{err: err}
+		}
+		m.inflight.finish(b.keys, b.calls, targets, err)
+	})
+	if bisect {
+		half := len(b.keys) / 2
+		m.translateBatch(ctx, id, metadata, b.slice(0, half))
+		m.translateBatch(ctx, id, metadata, b.slice(half, len(b.keys)))
+	}
+}
@@ -0,0 +1,148 @@
+//go:build unit
+// +build unit
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/msf/cachingproxy/handler"
+	"github.com/msf/cachingproxy/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchLimitsSplit(t *testing.T) {
+	sources := []string{"aaaa", "bb", "cccccccc", "d", "e", "f"}
+	lead := leadBatch{keys: sources, sources: sources, calls: make([]*segmentCall, len(sources))}
+
+	split := func(l batchLimits) [][]string {
+		var got [][]string
+		for _, b := range l.split(lead) {
+			got = append(got, b.sources)
+		}
+		return got
+	}
+	assert.Equal(t, [][]string{sources}, split(batchLimits{}))
+	assert.Equal(t, [][]string{{"aaaa", "bb"}, {"cccccccc", "d"}, {"e", "f"}},
+		split(batchLimits{maxSegments: 2}))
+	// the long segment goes alone
+	assert.Equal(t, [][]string{{"aaaa", "bb"}, {"cccccccc"}, {"d", "e", "f"}},
+		split(batchLimits{maxChars: 6}))
+	assert.Equal(t, [][]string{{"aaaa"}, {"bb"}, {"cccccccc"}, {"d", "e"}, {"f"}},
+		split(batchLimits{maxSegments: 2, maxChars: 5}))
+}
+
+func TestHandleTranslatesInBatches(t *testing.T) {
+	remote := &fakeTranslator{}
+	h := newTestHandler(t, remote)
+	h.batchLimits = batchLimits{maxSegments: 2}
+
+	resp, err := h.Handle(context.Background(), &model.MachineTranslationRequest{
+		Segments: []string{"a", "b", "c", "d", "e"},
+		Metadata: model.MTRequestMetadata{SourceLang: "en", TargetLang: "de"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []model.TargetSegment{
+		"translated a", "translated b", "translated c", "translated d", "translated e",
+	}, resp.TargetSegments)
+
+	// the batches are concurrent, in any order
+	sort.Slice(remote.requests, func(i, j int) bool { return remote.requests[i][0] < remote.requests[j][0] })
+	assert.Equal(t, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}, remote.requests)
+}
+
+// rejectingTranslator rejects the requests with the bad segment
+type rejectingTranslator struct {
+	fakeTranslator
+	bad string
+}
+
+func (f *rejectingTranslator) Handle(
+	ctx context.Context, req *model.MachineTranslationRequest,
+) (*model.MachineTranslationResponse, error) {
+	for _, s := range req.Segments {
+		if s == f.bad {
+			f.mu.Lock()
+			f.requests = append(f.requests, req.Segments)
+			f.mu.Unlock()
+			return nil, &handler.UpstreamError{Host: "mt.local", StatusCode: 422, Segment: true, Err: fmt.Errorf("bad")}
+		}
+	}
+	return f.fakeTranslator.Handle(ctx, req)
+}
+
+func TestHandleBisectsRejectedBatches(t *testing.T) {
+	remote := &rejectingTranslator{bad: "c"}
+	h := newTestHandler(t, &remote.fakeTranslator)
+	h.remoteTranslator = remote
+
+	resp, err := h.Handle(context.Background(), &model.MachineTranslationRequest{
+		Segments:     []string{"a", "b", "c", "d", "e"},
+		Metadata:     model.MTRequestMetadata{SourceLang: "en", TargetLang: "nl"},
+		AllowPartial: true,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []model.TargetSegment{"translated a", "translated b", "", "translated d", "translated e"},
+		resp.TargetSegments)
+	assert.Equal(t, model.SegmentFailed, resp.SegmentStatus[2].Status)
+	assert.Equal(t, [][]string{{"a", "b", "c", "d", "e"}, {"a", "b"}, {"c", "d", "e"}, {"c"}, {"d", "e"}},
+		remote.requests)
+}
+
+// gatedTranslator holds every request until the gate lets it through
+type gatedTranslator struct {
+	fakeTranslator
+	gate             chan struct{}
+	running, maxSeen int
+}
+
+func (f *gatedTranslator) Handle(
+	ctx context.Context, req *model.MachineTranslationRequest,
+) (*model.MachineTranslationResponse, error) {
+	f.mu.Lock()
+	f.running++
+	if f.running > f.maxSeen {
+		f.maxSeen = f.running
+	}
+	f.mu.Unlock()
+	<-f.gate
+	f.mu.Lock()
+	f.running--
+	f.mu.Unlock()
+	return f.fakeTranslator.Handle(ctx, req)
+}
+
+func TestHandleBoundsConcurrentBatches(t *testing.T) {
+	remote := &gatedTranslator{gate: make(chan struct{})}
+	h := newTestHandler(t, &remote.fakeTranslator)
+	h.remoteTranslator = remote
+	h.batchLimits = batchLimits{maxSegments: 1}
+	h.maxConcurrentBatches = 2
+
+	segments := []string{"a", "b", "c", "d", "e", "f"}
+	done := make(chan *model.MachineTranslationResponse)
+	go func() {
+		resp, err := h.Handle(context.Background(), &model.MachineTranslationRequest{
+			Segments: segments,
+			Metadata: model.MTRequestMetadata{SourceLang: "en", TargetLang: "sv"},
+		})
+		assert.Nil(t, err)
+		done <- resp
+	}()
+	for i := range segments {
+		// each batch done lets the next one in
+		assert.Eventually(t, func() bool {
+			remote.mu.Lock()
+			defer remote.mu.Unlock()
+			return remote.running == 2 || len(segments)-i < 2
+		}, time.Second, time.Millisecond)
+		remote.gate <- struct{}{}
+	}
+	resp := <-done
+	assert.Len(t, resp.TargetSegments, len(segments))
+	assert.Equal(t, 2, remote.maxSeen)
+}
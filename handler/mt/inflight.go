@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/msf/cachingproxy/model"
+)
+
+var errTranslationAborted = fmt.Errorf("in-flight translation aborted")
+
+// leaderGoneError is the failure of a call whose leading request went away before it was
+// translated. Unlike any other failure, the waiters may take the call over and send it again.
+type leaderGoneError struct {
+	err error
+}
+
+func (e *leaderGoneError) Error() string {
+	return "request translating the segment went away: " + e.err.Error()
+}
+
+func (e *leaderGoneError) Unwrap() error {
+	return e.err
+}
+
+// segmentCall is one upstream translation of a segment, shared by every request
+// that missed it while it was in flight
+type segmentCall struct {
+	done chan struct{}
+	val  model.TargetSegment
+	err  error
+}
+
+// inflightSegments coalesces concurrent cache misses for the same segment, keyed by
+// mtcache.KeysFor. Like singleflight, but a caller leads a batch of keys at once.
+type inflightSegments struct {
+	mu    sync.Mutex
+	calls map[string]*segmentCall
+}
+
+func newInflightSegments() *inflightSegments {
+	return &inflightSegments{
+		calls: make(map[string]*segmentCall),
+	}
+}
+
+// join returns the call for each key, leading[i] is true when the caller must translate
+// keys[i] and then finish it, otherwise the call is already in flight and only needs a wait.
+func (g *inflightSegments) join(keys []string) (calls []*segmentCall, leading []bool) {
+	calls = make([]*segmentCall, len(keys))
+	leading = make([]bool, len(keys))
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i, k := range keys {
+		c, found := g.calls[k]
+		if !found {
+			c = &segmentCall{done: make(chan struct{})}
+			g.calls[k] = c
+			leading[i] = true
+		}
+		calls[i] = c
+	}
+	return calls, leading
+}
+
+// finish publishes the results of the calls led by the caller and wakes up their waiters.
+// vals is ignored when err is set.
+func (g *inflightSegments) finish(
+	keys []string, calls []*segmentCall, vals []model.TargetSegment, err error,
+) {
+	g.mu.Lock()
+	for i, k := range keys {
+		if g.calls[k] == calls[i] {
+			delete(g.calls, k)
+		}
+	}
+	g.mu.Unlock()
+
+	for i, c := range calls {
+		if err != nil {
+			c.err = err
+		} else {
+			c.val = vals[i]
+		}
+		close(c.done)
+	}
+}
+
+// leadBatch are the segments a caller must translate and then finish
+type leadBatch struct {
+	keys    []string
+	sources []string
+	calls   []*segmentCall
+}
+
+func leadBatchOf(keys, sources []string, calls []*segmentCall, leading []bool) leadBatch {
+	b := leadBatch{
+		keys:    make([]string, 0, len(keys)),
+		sources: make([]string, 0, len(keys)),
+		calls:   make([]*segmentCall, 0, len(keys)),
+	}
+	for i, lead := range leading {
+		if lead {
+			b.keys = append(b.keys, keys[i])
+			b.sources = append(b.sources, sources[i])
+			b.calls = append(b.calls, calls[i])
+		}
+	}
+	return b
+}
+
+// wait returns the call outcome, or ctx.Err() if ctx is done first. The call itself
+// carries on for the other waiters.
+func (c *segmentCall) wait(ctx context.Context) (model.TargetSegment, error) {
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
@@ -1,7 +1,11 @@
 package handler
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"time"
 
 	"github.com/msf/cachingproxy/handler"
 	"github.com/msf/cachingproxy/handler/mtcache"
@@ -10,36 +14,48 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// maxRevalidations bounds the concurrent background refreshes of stale cache entries
+const maxRevalidations = 16
+
 type cachingMTHandler struct {
 	localCache       mtcache.MachineTranslationCache
 	remoteTranslator handler.MachineTranslationHandler
+	inflight         *inflightSegments
+	revalidations    chan struct{}
+	batchLimits      batchLimits
+	// maxConcurrentBatches bounds the batches of a request sent at once, zero is unlimited
+	maxConcurrentBatches int
+	cacheOnly            bool
 }
 
+// NewCachingMTHandler serves from cache, only sending the misses to maestro.
+// The cache is owned by the caller, which must Close it.
 func NewCachingMTHandler(
-	cacheConfig mtcache.Config, routingMap map[mtproxy.RoutingKey]string,
+	cache mtcache.MachineTranslationCache, proxyConfig mtproxy.Config,
 ) (handler.MachineTranslationHandler, error) {
 
-	cache, err := mtcache.NewCachingSegmentTranslator(cacheConfig)
-	if err != nil {
-		return nil, err
-	}
-	remote, err := mtproxy.NewMaestroProxyTranslator(routingMap)
+	remote, err := mtproxy.NewMaestroProxyTranslator(proxyConfig)
 	if err != nil {
 		return nil, err
 	}
 	return &cachingMTHandler{
 		localCache:       cache,
 		remoteTranslator: remote,
+		inflight:         newInflightSegments(),
+		revalidations:    make(chan struct{}, maxRevalidations),
+		batchLimits: batchLimits{
+			maxSegments: proxyConfig.MaxBatchSegments,
+			maxChars:    proxyConfig.MaxBatchChars,
+		},
+		maxConcurrentBatches: proxyConfig.MaxRouteConcurrency,
+		cacheOnly:            proxyConfig.Breaker.CacheOnly,
 	}, nil
 }
 
 func (m *cachingMTHandler) Handle(
-	req *model.MachineTranslationRequest,
+	ctx context.Context, req *model.MachineTranslationRequest,
 ) (resp *model.MachineTranslationResponse, err error) {
-	if err := req.HasError(); err != nil {
-		return resp, fmt.Errorf("handler: invalid message: %#v, %v", req, err)
-	}
-
+	// requests are validated by the server, against its configured limits
 	log.WithFields(log.Fields{
 		"id":           req.ID,
 		"sourceLang":   req.Metadata.SourceLang,
@@ -48,17 +64,20 @@ func (m *cachingMTHandler) Handle(
 	}).Info("MachineTranslate")
 
 	// fetch from cache
-	resp, err = m.localCache.Handle(req)
+	resp, stale, err := m.localCache.Fetch(ctx, req)
 	if err != nil {
 		log.Error("cache req failed", err)
 		// TODO more metrics
-		return resp, err
+		if ctx.Err() != nil {
+			return resp, err
+		}
+		return resp, &handler.CacheError{Op: "fetch", Err: err}
 	}
 
 	// find what we're missing
 	hitCount := len(req.Segments)
-	missingSources := make([]string, len(resp.TargetSegments)/2)
-	missingIndexes := make([]int, len(resp.TargetSegments)/2)
+	missingSources := make([]string, 0, len(resp.TargetSegments)/2)
+	missingIndexes := make([]int, 0, len(resp.TargetSegments)/2)
 	for i, v := range resp.TargetSegments {
 		if v == "" && req.Segments[i] != "" {
 			hitCount--
@@ -67,35 +86,225 @@ func (m *cachingMTHandler) Handle(
 		}
 	}
 
-	// get the missing segments
-	rResp, err := m.remoteTranslator.Handle(&model.MachineTranslationRequest{
-		ID:       req.ID,
-		Metadata: req.Metadata,
-		Segments: missingSources,
-	})
-	if err != nil {
-		log.Error("remoteTranslator failed", err)
-		// TODO more metrics
-		return resp, err
-	}
+	md := req.Metadata
+	segmentsCounter.WithLabelValues(md.SourceLang, md.TargetLang, resultHit).Add(float64(hitCount))
+	segmentsCounter.WithLabelValues(md.SourceLang, md.TargetLang, resultMiss).Add(float64(len(missingIndexes)))
 
-	er := m.localCache.Save(req.Metadata, req.Segments, rResp.TargetSegments)
-	if er != nil {
-		log.Error("locaCache.Save() failed", er)
+	if len(stale) > 0 {
+		m.revalidate(req, stale)
 	}
 
-	// finish the response results
-	for i, v := range rResp.TargetSegments {
-		pos := missingIndexes[i]
-		resp.TargetSegments[pos] = v
+	coalesced, failed := 0, 0
+	if len(missingIndexes) > 0 {
+		var errs []error
+		coalesced, errs = m.translateMissing(ctx, req, resp, missingSources, missingIndexes)
+		failed, err = countFailures(errs)
+		// with the engine unavailable, cacheOnly answers with the cache hits alone
+		partial := req.AllowPartial || (m.cacheOnly && errors.Is(err, handler.ErrUpstreamUnavailable))
+		// partial responses are only worth it if some segment was translated
+		if err != nil && (!partial || (failed == len(missingIndexes) && hitCount == 0)) {
+			return resp, err
+		}
+		if partial {
+			resp.SegmentStatus = segmentStatus(len(req.Segments), missingIndexes, errs)
+		}
+	} else if req.AllowPartial {
+		resp.SegmentStatus = segmentStatus(len(req.Segments), nil, nil)
 	}
 
-	//TODO: emit metrics to prometheus
 	log.WithFields(log.Fields{
 		"hitCount":  hitCount,
 		"missCount": len(missingIndexes),
+		"failed":    failed,
+		"coalesced": coalesced,
+		"stale":     len(stale),
 		"metrics":   m.localCache.Metrics(),
 	}).Info("Translation Complete")
 
 	return resp, nil
 }
+
+// maxRejoins bounds how many times a request takes over the segments it was waiting on,
+// after the request translating them went away
+const maxRejoins = 3
+
+// translateMissing fills in the cache misses on resp. Segments already being translated for
+// a concurrent request are waited on, the others are fetched from the remoteTranslator.
+// errs[i] is the failure of missingIndexes[i], if any.
+func (m *cachingMTHandler) translateMissing(
+	ctx context.Context,
+	req *model.MachineTranslationRequest,
+	resp *model.MachineTranslationResponse,
+	missingSources []string,
+	missingIndexes []int,
+) (coalesced int, errs []error) {
+	keys := mtcache.KeysFor(req.Metadata, missingSources)
+	errs = make([]error, len(keys))
+	pending := make([]int, len(keys))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	for rejoins := 0; len(pending) > 0; rejoins++ {
+		pendingKeys := make([]string, len(pending))
+		pendingSources := make([]string, len(pending))
+		for j, i := range pending {
+			pendingKeys[j], pendingSources[j] = keys[i], missingSources[i]
+		}
+		calls, leading := m.inflight.join(pendingKeys)
+
+		lead := leadBatchOf(pendingKeys, pendingSources, calls, leading)
+		if len(lead.keys) > 0 {
+			// a failure reaches every call of its batch, it's collected below
+			m.translateBatches(ctx, req.ID, req.Metadata, lead)
+		}
+		if rejoins == 0 {
+			coalesced = len(pendingKeys) - len(lead.keys)
+		}
+
+		var retry []int
+		for j, c := range calls {
+			i := pending[j]
+			v, err := c.wait(ctx)
+			var gone *leaderGoneError
+			if !leading[j] && errors.As(err, &gone) && ctx.Err() == nil && rejoins < maxRejoins {
+				// the request translating it went away, not this one: take it over
+				retry = append(retry, i)
+				continue
+			}
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			resp.TargetSegments[missingIndexes[i]] = v
+		}
+		pending = retry
+	}
+	return coalesced, errs
+}
+
+// countFailures returns how many errs are set, and the first of them
+func countFailures(errs []error) (failed int, first error) {
+	for _, err := range errs {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+	return failed, first
+}
+
+// segmentStatus builds the status of every segment, the ones at missingIndexes failed
+// with errs, when set. Any other segment was translated.
+func segmentStatus(count int, missingIndexes []int, errs []error) []model.SegmentStatus {
+	status := make([]model.SegmentStatus, count)
+	for i := range status {
+		status[i].Status = model.SegmentOK
+	}
+	for i, pos := range missingIndexes {
+		if errs[i] != nil {
+			status[pos] = model.SegmentStatus{Status: model.SegmentFailed, ErrorCode: handler.ErrorCode(errs[i])}
+		}
+	}
+	return status
+}
+
+// revalidate refreshes the stale segments in the background, unless they are already in
+// flight. It never blocks: when maxRevalidations are running the refresh is skipped.
+func (m *cachingMTHandler) revalidate(req *model.MachineTranslationRequest, stale []int) {
+	select {
+	case m.revalidations <- struct{}{}:
+	default:
+		revalidationsCounter.WithLabelValues(revalidationSkipped).Inc()
+		return
+	}
+
+	sources := make([]string, len(stale))
+	for i, pos := range stale {
+		sources[i] = req.Segments[pos]
+	}
+	keys := mtcache.KeysFor(req.Metadata, sources)
+	calls, leading := m.inflight.join(keys)
+
+	lead := leadBatchOf(keys, sources, calls, leading)
+	if len(lead.keys) == 0 {
+		<-m.revalidations
+		return
+	}
+
+	revalidationsCounter.WithLabelValues(revalidationStarted).Inc()
+	go func() {
+		defer func() { <-m.revalidations }()
+		// outlives the request that found the stale entries, Drain waits for it.
+		// Failures are logged by translateRemote, the stale entries stay until their MaxTTL.
+		m.translateBatches(context.Background(), req.ID, req.Metadata, lead)
+	}()
+}
+
+// Drain waits for the background revalidations to finish, so their results reach the
+// localCache before it is closed. No new revalidations are started afterwards, and the
+// remoteTranslator is closed.
+func (m *cachingMTHandler) Drain(ctx context.Context) error {
+	if c, ok := m.remoteTranslator.(io.Closer); ok {
+		defer c.Close()
+	}
+	for i := 0; i < cap(m.revalidations); i++ {
+		select {
+		case m.revalidations <- struct{}{}:
+		case <-ctx.Done():
+			// give back the slots taken so far, the running revalidations release theirs
+			for ; i > 0; i-- {
+				<-m.revalidations
+			}
+			return fmt.Errorf("draining revalidations: %w", ctx.Err())
+		}
+	}
+	return nil
+}
+
+// translateRemote fetches the sources from the remoteTranslator and saves them to the
+// localCache, done is always called with the outcome, even if the remoteTranslator panics.
+func (m *cachingMTHandler) translateRemote(
+	ctx context.Context,
+	id string,
+	metadata model.MTRequestMetadata,
+	sources []string,
+	done func([]model.TargetSegment, error),
+) (err error) {
+	var targets []model.TargetSegment
+	err = errTranslationAborted
+	defer func() {
+		done(targets, err)
+	}()
+
+	start := time.Now()
+	rResp, err := m.remoteTranslator.Handle(ctx, &model.MachineTranslationRequest{
+		ID:       id,
+		Metadata: metadata,
+		Segments: sources,
+	})
+	status := statusOK
+	if err != nil {
+		status = statusErr
+	}
+	upstreamDuration.WithLabelValues(metadata.SourceLang, metadata.TargetLang, status).
+		Observe(time.Since(start).Seconds())
+	if err != nil {
+		log.Error("remoteTranslator failed", err)
+		// TODO more metrics
+		return err
+	}
+	if len(rResp.TargetSegments) != len(sources) {
+		return fmt.Errorf("remoteTranslator returned %v segments, expected %v",
+			len(rResp.TargetSegments), len(sources))
+	}
+
+	er := m.localCache.Save(metadata, sources, rResp.TargetSegments)
+	if er != nil {
+		log.Error("locaCache.Save() failed", er)
+	}
+	targets = rResp.TargetSegments
+	return nil
+}
@@ -0,0 +1,381 @@
+//go:build unit
+// +build unit
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/msf/cachingproxy/handler"
+	"github.com/msf/cachingproxy/handler/mtcache"
+	"github.com/msf/cachingproxy/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeTranslator struct {
+	mu       sync.Mutex
+	requests [][]string
+	err      error
+}
+
+func (f *fakeTranslator) Handle(
+	ctx context.Context, req *model.MachineTranslationRequest,
+) (*model.MachineTranslationResponse, error) {
+	f.mu.Lock()
+	f.requests = append(f.requests, req.Segments)
+	f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	targets := make([]model.TargetSegment, len(req.Segments))
+	for i, s := range req.Segments {
+		targets[i] = model.TargetSegment("translated " + s)
+	}
+	return &model.MachineTranslationResponse{RequestID: req.ID, TargetSegments: targets}, nil
+}
+
+func newTestHandler(t *testing.T, remote *fakeTranslator) *cachingMTHandler {
+	return newTestHandlerWithCache(t, remote, mtcache.Config{MaxSizeMB: 1, MaxTTL: time.Minute})
+}
+
+func newTestHandlerWithCache(t *testing.T, remote *fakeTranslator, cfg mtcache.Config) *cachingMTHandler {
+	cache, err := mtcache.NewCachingSegmentTranslator(cfg)
+	assert.Nil(t, err)
+	t.Cleanup(func() { cache.Close() })
+	return &cachingMTHandler{
+		localCache:       cache,
+		remoteTranslator: remote,
+		inflight:         newInflightSegments(),
+		revalidations:    make(chan struct{}, maxRevalidations),
+	}
+}
+
+func histogramCount(t *testing.T, o prometheus.Observer) uint64 {
+	var m dto.Metric
+	assert.Nil(t, o.(prometheus.Metric).Write(&m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+// waitCached waits for ristretto's async set of the segment to land
+func waitCached(t *testing.T, h *cachingMTHandler, md model.MTRequestMetadata, segment string) {
+	assert.Eventually(t, func() bool {
+		_, found := h.localCache.Lookup(md, segment)
+		return found
+	}, time.Second, time.Millisecond)
+}
+
+func (f *fakeTranslator) requestCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests)
+}
+
+func TestHandleTranslatesMisses(t *testing.T) {
+	remote := &fakeTranslator{}
+	h := newTestHandler(t, remote)
+	// the metrics are global, only their change is down to this test
+	misses := segmentsCounter.WithLabelValues("en", "pt", resultMiss)
+	upstream := upstreamDuration.WithLabelValues("en", "pt", statusOK)
+	missesBefore, upstreamBefore := testutil.ToFloat64(misses), histogramCount(t, upstream)
+
+	resp, err := h.Handle(context.Background(), &model.MachineTranslationRequest{
+		ID:       "1",
+		Segments: []string{"hello", "", "hello", "bye"},
+		Metadata: model.MTRequestMetadata{SourceLang: "en", TargetLang: "pt"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []model.TargetSegment{"translated hello", "", "translated hello", "translated bye"},
+		resp.TargetSegments)
+	// repeated segments are only sent once
+	assert.Equal(t, [][]string{{"hello", "bye"}}, remote.requests)
+	assert.Equal(t, 3.0, testutil.ToFloat64(misses)-missesBefore)
+	assert.Equal(t, uint64(1), histogramCount(t, upstream)-upstreamBefore)
+}
+
+func TestHandleRevalidatesStale(t *testing.T) {
+	remote := &fakeTranslator{}
+	// every entry is stale as soon as it is saved
+	h := newTestHandlerWithCache(t, remote, mtcache.Config{MaxSizeMB: 1, MaxTTL: time.Hour, SoftTTL: time.Nanosecond})
+	md := model.MTRequestMetadata{SourceLang: "en", TargetLang: "fr"}
+	assert.Nil(t, h.localCache.Save(md, []string{"hello"}, []model.TargetSegment{"old hello"}))
+	waitCached(t, h, md, "hello")
+
+	resp, err := h.Handle(context.Background(), &model.MachineTranslationRequest{Segments: []string{"hello"}, Metadata: md})
+	assert.Nil(t, err)
+	// the stale value is served right away
+	assert.Equal(t, []model.TargetSegment{"old hello"}, resp.TargetSegments)
+
+	assert.Eventually(t, func() bool {
+		entry, found := h.localCache.Lookup(md, "hello")
+		return found && entry.Target == "translated hello"
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, [][]string{{"hello"}}, remote.requests)
+}
+
+func TestRevalidateIsBounded(t *testing.T) {
+	remote := &fakeTranslator{}
+	h := newTestHandler(t, remote)
+	for i := 0; i < maxRevalidations; i++ {
+		h.revalidations <- struct{}{}
+	}
+	// skipped right away, no goroutine is started
+	h.revalidate(&model.MachineTranslationRequest{Segments: []string{"hello"}}, []int{0})
+	assert.Equal(t, 0, remote.requestCount())
+	assert.Empty(t, h.inflight.calls)
+}
+
+func TestHandleRemoteError(t *testing.T) {
+	h := newTestHandler(t, &fakeTranslator{err: fmt.Errorf("boom")})
+	_, err := h.Handle(context.Background(), &model.MachineTranslationRequest{
+		Segments: []string{"hello"},
+		Metadata: model.MTRequestMetadata{SourceLang: "en", TargetLang: "pt"},
+	})
+	assert.NotNil(t, err)
+	assert.Empty(t, h.inflight.calls)
+}
+
+func TestInflightSegmentsShareResult(t *testing.T) {
+	g := newInflightSegments()
+	leaderCalls, leading := g.join([]string{"a", "b"})
+	assert.Equal(t, []bool{true, true}, leading)
+
+	followerCalls, leading := g.join([]string{"b", "c"})
+	assert.Equal(t, []bool{false, true}, leading)
+	assert.Same(t, leaderCalls[1], followerCalls[0])
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		v, err := followerCalls[0].wait(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, model.TargetSegment("B"), v)
+	}()
+
+	g.finish([]string{"a", "b"}, leaderCalls, []model.TargetSegment{"A", "B"}, nil)
+	wg.Wait()
+
+	// finished keys are no longer in flight
+	_, leading = g.join([]string{"a"})
+	assert.Equal(t, []bool{true}, leading)
+}
+
+func TestInflightSegmentsShareError(t *testing.T) {
+	g := newInflightSegments()
+	calls, _ := g.join([]string{"a"})
+	followers, _ := g.join([]string{"a"})
+	g.finish([]string{"a"}, calls, nil, errTranslationAborted)
+	_, err := followers[0].wait(context.Background())
+	assert.Equal(t, errTranslationAborted, err)
+}
+
+func TestDrainWaitsForRevalidations(t *testing.T) {
+	h := newTestHandler(t, &fakeTranslator{})
+	h.revalidations <- struct{}{} // a revalidation in flight
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, h.Drain(ctx), context.DeadlineExceeded)
+
+	<-h.revalidations
+	assert.Nil(t, h.Drain(context.Background()))
+	// once drained, no new revalidations start
+	h.revalidate(&model.MachineTranslationRequest{Segments: []string{"hello"}}, []int{0})
+	assert.Empty(t, h.inflight.calls)
+}
+
+func TestInflightSegmentsWaitCancelled(t *testing.T) {
+	g := newInflightSegments()
+	calls, _ := g.join([]string{"a"})
+	followers, _ := g.join([]string{"a"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := followers[0].wait(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// the leader still publishes its result for the remaining waiters
+	g.finish([]string{"a"}, calls, []model.TargetSegment{"A"}, nil)
+	v, err := followers[0].wait(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, model.TargetSegment("A"), v)
+}
+
+// cancelledTranslator blocks the first request until its ctx is done, the later ones translate
+type cancelledTranslator struct {
+	fakeTranslator
+	started chan struct{}
+}
+
+func (f *cancelledTranslator) Handle(
+	ctx context.Context, req *model.MachineTranslationRequest,
+) (*model.MachineTranslationResponse, error) {
+	if f.requestCount() == 0 {
+		f.mu.Lock()
+		f.requests = append(f.requests, req.Segments)
+		f.mu.Unlock()
+		close(f.started)
+		<-ctx.Done()
+		return nil, &handler.UpstreamError{Host: "mt.local", Err: ctx.Err()}
+	}
+	return f.fakeTranslator.Handle(ctx, req)
+}
+
+func TestHandleFollowerTakesOverCancelledLeader(t *testing.T) {
+	remote := &cancelledTranslator{started: make(chan struct{})}
+	cache, err := mtcache.NewCachingSegmentTranslator(mtcache.Config{MaxSizeMB: 1, MaxTTL: time.Minute})
+	assert.Nil(t, err)
+	t.Cleanup(func() { cache.Close() })
+	h := &cachingMTHandler{
+		localCache:       cache,
+		remoteTranslator: remote,
+		inflight:         newInflightSegments(),
+		revalidations:    make(chan struct{}, maxRevalidations),
+	}
+	req := &model.MachineTranslationRequest{
+		Segments: []string{"hello"},
+		Metadata: model.MTRequestMetadata{SourceLang: "en", TargetLang: "it"},
+	}
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leaderErr := make(chan error)
+	go func() {
+		_, err := h.Handle(leaderCtx, req)
+		leaderErr <- err
+	}()
+	<-remote.started
+
+	followerResp := make(chan *model.MachineTranslationResponse)
+	go func() {
+		// the follower leads "bye" and then waits on the leader "hello"
+		resp, err := h.Handle(context.Background(), &model.MachineTranslationRequest{
+			Segments: []string{"hello", "bye"},
+			Metadata: req.Metadata,
+		})
+		assert.Nil(t, err)
+		followerResp <- resp
+	}()
+	assert.Eventually(t, func() bool { return remote.requestCount() == 2 }, time.Second, time.Millisecond)
+	cancelLeader()
+
+	assert.ErrorIs(t, <-leaderErr, context.Canceled)
+	resp := <-followerResp
+	assert.Equal(t, []model.TargetSegment{"translated hello", "translated bye"}, resp.TargetSegments)
+	assert.Equal(t, [][]string{{"hello"}, {"bye"}, {"hello"}}, remote.requests)
+}
+
+// timingOutTranslator times out the "hello" requests once released, the others translate
+type timingOutTranslator struct {
+	fakeTranslator
+	release chan struct{}
+}
+
+func (f *timingOutTranslator) Handle(
+	ctx context.Context, req *model.MachineTranslationRequest,
+) (*model.MachineTranslationResponse, error) {
+	if req.Segments[0] == "hello" {
+		f.mu.Lock()
+		f.requests = append(f.requests, req.Segments)
+		f.mu.Unlock()
+		<-f.release
+		return nil, &handler.UpstreamError{Host: "mt.local", Err: context.DeadlineExceeded}
+	}
+	return f.fakeTranslator.Handle(ctx, req)
+}
+
+func TestHandleFollowersDontResendTimedOutSegments(t *testing.T) {
+	remote := &timingOutTranslator{release: make(chan struct{})}
+	h := newTestHandler(t, &remote.fakeTranslator)
+	h.remoteTranslator = remote
+	md := model.MTRequestMetadata{SourceLang: "en", TargetLang: "es"}
+
+	const followers = 4
+	errs := make(chan error, followers+1)
+	go func() {
+		_, err := h.Handle(context.Background(), &model.MachineTranslationRequest{Segments: []string{"hello"}, Metadata: md})
+		errs <- err
+	}()
+	assert.Eventually(t, func() bool { return remote.requestCount() == 1 }, time.Second, time.Millisecond)
+	for i := 0; i < followers; i++ {
+		i := i
+		go func() {
+			// each follower leads its own segment and then waits on the leader "hello"
+			_, err := h.Handle(context.Background(), &model.MachineTranslationRequest{
+				Segments: []string{"hello", fmt.Sprint("bye ", i)}, Metadata: md,
+			})
+			errs <- err
+		}()
+	}
+	assert.Eventually(t, func() bool { return remote.requestCount() == 1+followers }, time.Second, time.Millisecond)
+	close(remote.release)
+
+	for i := 0; i < followers+1; i++ {
+		err := <-errs
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	}
+	hellos := 0
+	for _, segments := range remote.requests {
+		if segments[0] == "hello" {
+			hellos++
+		}
+	}
+	assert.Equal(t, 1, hellos)
+}
+
+func TestHandlePartialResponse(t *testing.T) {
+	remote := &fakeTranslator{err: &handler.UpstreamError{Host: "mt.local", Err: fmt.Errorf("boom")}}
+	h := newTestHandler(t, remote)
+	md := model.MTRequestMetadata{SourceLang: "en", TargetLang: "it"}
+	assert.Nil(t, h.localCache.Save(md, []string{"hello"}, []model.TargetSegment{"ciao"}))
+	waitCached(t, h, md, "hello")
+
+	req := &model.MachineTranslationRequest{Segments: []string{"hello", "bye"}, Metadata: md}
+	_, err := h.Handle(context.Background(), req)
+	assert.NotNil(t, err)
+
+	req.AllowPartial = true
+	resp, err := h.Handle(context.Background(), req)
+	assert.Nil(t, err)
+	assert.True(t, resp.IsPartial())
+	assert.Equal(t, []model.TargetSegment{"ciao", ""}, resp.TargetSegments)
+	assert.Equal(t, []model.SegmentStatus{
+		{Status: model.SegmentOK},
+		{Status: model.SegmentFailed, ErrorCode: handler.CodeUpstreamFailed},
+	}, resp.SegmentStatus)
+
+	// with nothing to show, the error is returned
+	_, err = h.Handle(context.Background(), &model.MachineTranslationRequest{
+		Segments: []string{"bye"}, Metadata: md, AllowPartial: true,
+	})
+	assert.NotNil(t, err)
+}
+
+func TestHandleCacheOnlyWhenUnavailable(t *testing.T) {
+	remote := &fakeTranslator{err: &handler.UpstreamError{Host: "mt.local", Err: handler.ErrUpstreamUnavailable}}
+	h := newTestHandler(t, remote)
+	h.cacheOnly = true
+	md := model.MTRequestMetadata{SourceLang: "en", TargetLang: "nl"}
+	assert.Nil(t, h.localCache.Save(md, []string{"hello"}, []model.TargetSegment{"hallo"}))
+	waitCached(t, h, md, "hello")
+
+	resp, err := h.Handle(context.Background(), &model.MachineTranslationRequest{
+		Segments: []string{"hello", "bye"}, Metadata: md,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []model.TargetSegment{"hallo", ""}, resp.TargetSegments)
+	assert.Equal(t, handler.CodeUpstreamUnavailable, resp.SegmentStatus[1].ErrorCode)
+
+	// other failures still fail the request
+	remote.err = &handler.UpstreamError{Host: "mt.local", Err: fmt.Errorf("boom")}
+	_, err = h.Handle(context.Background(), &model.MachineTranslationRequest{
+		Segments: []string{"hello", "bye"}, Metadata: md,
+	})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	resultHit  = "hit"
+	resultMiss = "miss"
+	statusOK   = "ok"
+	statusErr  = "error"
+
+	revalidationStarted = "started"
+	revalidationSkipped = "skipped"
+)
+
+var (
+	segmentsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mtproxy",
+		Name:      "segments_total",
+		Help:      "Translated segments by language pair and cache result (hit or miss).",
+	}, []string{"source_lang", "target_lang", "result"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mtproxy",
+		Name:      "upstream_duration_seconds",
+		Help:      "Latency of the remote translator calls, by language pair and status.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 20, 40, 80},
+	}, []string{"source_lang", "target_lang", "status"})
+
+	revalidationsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mtproxy",
+		Name:      "revalidations_total",
+		Help:      "Background refreshes of stale cache entries, started or skipped when at capacity.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(segmentsCounter, upstreamDuration, revalidationsCounter)
+}
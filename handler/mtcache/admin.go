@@ -0,0 +1,142 @@
+package mtcache
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/msf/cachingproxy/model"
+)
+
+const (
+	TierMemory = "memory"
+	TierDisk   = "disk"
+)
+
+// Entry is a cached translation, as seen by the admin API
+type Entry struct {
+	Target model.TargetSegment `json:"target"`
+	TTL    time.Duration       `json:"ttl"`
+	Tier   string              `json:"tier"`
+}
+
+// Purged counts the entries removed from each tier, a segment may be in both
+type Purged struct {
+	Memory int `json:"memory"`
+	Disk   int `json:"disk"`
+}
+
+// Stats are the ristretto metrics of the memory cache, and the size of the disk one
+type Stats struct {
+	Hits         uint64  `json:"hits"`
+	Misses       uint64  `json:"misses"`
+	Ratio        float64 `json:"ratio"`
+	KeysAdded    uint64  `json:"keys_added"`
+	KeysUpdated  uint64  `json:"keys_updated"`
+	KeysEvicted  uint64  `json:"keys_evicted"`
+	CostAdded    uint64  `json:"cost_added"`
+	CostEvicted  uint64  `json:"cost_evicted"`
+	SetsDropped  uint64  `json:"sets_dropped"`
+	SetsRejected uint64  `json:"sets_rejected"`
+	GetsDropped  uint64  `json:"gets_dropped"`
+	GetsKept     uint64  `json:"gets_kept"`
+	Keys         int     `json:"keys"`
+	// DiskKeys are the entries of the disk cache, expired ones included until swept
+	DiskKeys int `json:"disk_keys,omitempty"`
+}
+
+// Lookup finds the cached translation of a segment, without promoting disk hits.
+// Keys missing from the index are not looked up in memory, so they don't count as misses,
+// but ristretto has no way to read without counting, a memory hit shows up in Stats.
+func (c *machineTranslationCache) Lookup(md model.MTRequestMetadata, segment string) (Entry, bool) {
+	key := KeysFor(md, []string{segment})[0]
+	if c.indexed(key) {
+		if v, found := c.cache.Get(key); found {
+			ttl, _ := c.cache.GetTTL(key)
+			return Entry{Target: v.(model.TargetSegment), TTL: ttl, Tier: TierMemory}, true
+		}
+	}
+	if c.disk == nil {
+		return Entry{}, false
+	}
+	now := time.Now()
+	vals, expiries, found, err := c.disk.get([]string{key}, now)
+	if err != nil || !found[0] {
+		return Entry{}, false
+	}
+	return Entry{Target: vals[0], TTL: expiries[0].Sub(now), Tier: TierDisk}, true
+}
+
+// Delete removes the segments from every cache tier
+func (c *machineTranslationCache) Delete(md model.MTRequestMetadata, segments []string) error {
+	keys := KeysFor(md, segments)
+	for _, k := range keys {
+		c.del(k)
+	}
+	if c.disk != nil {
+		if err := c.disk.delete(keys); err != nil {
+			return fmt.Errorf("disk cache delete failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// PurgeLanguagePair removes every segment translated from sourceLang to targetLang,
+// returning how many entries were removed from memory and from disk.
+func (c *machineTranslationCache) PurgeLanguagePair(sourceLang, targetLang string) (Purged, error) {
+	prefix := languagePairPrefix(sourceLang, targetLang)
+	var purged Purged
+	for _, k := range c.indexedKeys() {
+		if strings.HasPrefix(k, prefix) {
+			c.del(k)
+			purged.Memory++
+		}
+	}
+	if c.disk != nil {
+		n, err := c.disk.deletePrefix(prefix)
+		if err != nil {
+			return purged, fmt.Errorf("disk cache purge failed: %w", err)
+		}
+		purged.Disk = n
+	}
+	return purged, nil
+}
+
+func (c *machineTranslationCache) Stats() Stats {
+	m := c.cache.Metrics
+	c.keysMu.Lock()
+	keys := len(c.keys)
+	c.keysMu.Unlock()
+	s := Stats{
+		Hits:         m.Hits(),
+		Misses:       m.Misses(),
+		Ratio:        m.Ratio(),
+		KeysAdded:    m.KeysAdded(),
+		KeysUpdated:  m.KeysUpdated(),
+		KeysEvicted:  m.KeysEvicted(),
+		CostAdded:    m.CostAdded(),
+		CostEvicted:  m.CostEvicted(),
+		SetsDropped:  m.SetsDropped(),
+		SetsRejected: m.SetsRejected(),
+		GetsDropped:  m.GetsDropped(),
+		GetsKept:     m.GetsKept(),
+		Keys:         keys,
+	}
+	if c.disk != nil {
+		s.DiskKeys = c.disk.len()
+	}
+	return s
+}
+
+func (c *machineTranslationCache) del(key string) {
+	c.cache.Del(key)
+	h, _ := z.KeyToHash(key)
+	c.forget(&ristretto.Item{Key: h})
+}
+
+// languagePairPrefix must match the start of KeysFor
+func languagePairPrefix(sourceLang, targetLang string) string {
+	return sourceLang + "|" + targetLang + "|"
+}
@@ -1,72 +1,151 @@
 package mtcache
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/ristretto"
+	"github.com/dgraph-io/ristretto/z"
 	"github.com/msf/cachingproxy/handler"
 	"github.com/msf/cachingproxy/model"
+	log "github.com/sirupsen/logrus"
 )
 
 type Config struct {
 	MaxSizeMB int64
 	MaxTTL    time.Duration
+	// SoftTTL enables stale-while-revalidate: entries older than SoftTTL are still served,
+	// until MaxTTL, but reported as stale so they get refreshed. Zero disables it.
+	SoftTTL time.Duration
+	// DiskDir enables the persistent second level cache, stored under this directory
+	DiskDir string
+	// DiskMaxEntries bounds the disk cache, the entries expiring first are evicted. Zero is unlimited.
+	DiskMaxEntries int
+	// SnapshotPath enables loading the cache contents from this file on startup,
+	// and writing them back to it on Close
+	SnapshotPath string
 }
 
 type MachineTranslationCache interface {
 	handler.MachineTranslationHandler
+	// Fetch is Handle, also returning the positions of the hits older than Config.SoftTTL
+	Fetch(context.Context, *model.MachineTranslationRequest) (*model.MachineTranslationResponse, []int, error)
 	Save(model.MTRequestMetadata, []string, []model.TargetSegment) error
 	Metrics() string
+	Close() error
+
+	// used by the admin API
+	Lookup(md model.MTRequestMetadata, segment string) (Entry, bool)
+	Delete(md model.MTRequestMetadata, segments []string) error
+	PurgeLanguagePair(sourceLang, targetLang string) (Purged, error)
+	Stats() Stats
 }
 
 type machineTranslationCache struct {
 	cache  *ristretto.Cache
+	disk   *diskCache // nil unless Config.DiskDir is set
 	config Config
+
+	// ristretto only keeps key hashes, the original keys are indexed here so the cache
+	// contents can be listed. Kept in sync on a best-effort basis by the ristretto callbacks.
+	keysMu sync.Mutex
+	keys   map[uint64]string
 }
 
 func NewCachingSegmentTranslator(config Config) (MachineTranslationCache, error) {
 	// docs of ristretto just say use 64  :-|
 	const BufferItemCount = 64
+	c := &machineTranslationCache{
+		config: config,
+		keys:   make(map[uint64]string),
+	}
 	cache, err := ristretto.NewCache(&ristretto.Config{
 		MaxCost:     config.MaxSizeMB << 20, // mb to bytes
 		BufferItems: BufferItemCount,
 		// assuming ~100bytes per entry
 		NumCounters: 10_000 * config.MaxSizeMB,
 		Metrics:     true,
+		OnEvict:     c.forget,
+		OnReject:    c.forget,
 	})
 	if err != nil {
 		return nil, err
 	}
-	return &machineTranslationCache{
-		cache:  cache,
-		config: config,
-	}, nil
+	c.cache = cache
+	if config.DiskDir != "" {
+		c.disk, err = newDiskCache(config.DiskDir, config.MaxTTL, config.DiskMaxEntries)
+		if err != nil {
+			cache.Close()
+			return nil, err
+		}
+	}
+	if config.SnapshotPath != "" {
+		// a missing or broken snapshot only means a cold start
+		n, err := c.loadSnapshotFile(config.SnapshotPath, time.Now())
+		if err != nil {
+			log.Error("cache snapshot load failed", err)
+		}
+		log.WithFields(log.Fields{
+			"path":    config.SnapshotPath,
+			"entries": n,
+		}).Info("cache snapshot loaded")
+	}
+	return c, nil
 }
 
 func (c *machineTranslationCache) Handle(
-	req *model.MachineTranslationRequest,
+	ctx context.Context, req *model.MachineTranslationRequest,
 ) (*model.MachineTranslationResponse, error) {
-	keys := keysFor(req.Metadata, req.Segments)
+	resp, _, err := c.Fetch(ctx, req)
+	return resp, err
+}
+
+func (c *machineTranslationCache) Fetch(
+	ctx context.Context, req *model.MachineTranslationRequest,
+) (*model.MachineTranslationResponse, []int, error) {
+	keys := KeysFor(req.Metadata, req.Segments)
 
 	resp := make([]model.TargetSegment, len(keys))
+	var missing, stale []int
 	for i, k := range keys {
 		var val model.TargetSegment
 		v, found := c.cache.Get(k)
 		if !found {
 			// empty strings to indicate cache miss
 			val = ""
+			missing = append(missing, i)
 		} else {
 			val = v.(model.TargetSegment)
+			if c.config.SoftTTL > 0 {
+				if ttl, ok := c.cache.GetTTL(k); ok && c.isStale(ttl) {
+					stale = append(stale, i)
+				}
+			}
 		}
 		resp[i] = val
 	}
+	if c.disk != nil && len(missing) > 0 {
+		// the memory hits are cheap, the disk is only worth it if someone still waits
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		stale = append(stale, c.fillFromDisk(keys, missing, resp)...)
+		sort.Ints(stale)
+	}
 	return &model.MachineTranslationResponse{
 		RequestID:       req.ID,
 		TargetSegments:  resp,
 		RequestMetadata: req.Metadata,
-	}, nil
+	}, stale, nil
+}
+
+// isStale is true once an entry saved with MaxTTL has lived longer than SoftTTL
+func (c *machineTranslationCache) isStale(remainingTTL time.Duration) bool {
+	return c.config.SoftTTL > 0 && c.config.MaxTTL-remainingTTL > c.config.SoftTTL
 }
 
 func (c *machineTranslationCache) Save(
@@ -79,36 +158,125 @@ func (c *machineTranslationCache) Save(
 		return fmt.Errorf("non matching source and target segment array lengths")
 	}
 
-	keys := keysFor(metadata, sourceSegments)
+	keys := KeysFor(metadata, sourceSegments)
 	for i, seg := range targetSegments {
-		c.cache.SetWithTTL(
-			keys[i],
-			seg,
-			int64(len([]byte(seg))),
-			c.config.MaxTTL,
-		)
+		c.set(keys[i], seg, c.config.MaxTTL)
+	}
+	if c.disk != nil {
+		if err := c.disk.set(keys, targetSegments, time.Now()); err != nil {
+			return fmt.Errorf("disk cache save failed: %w", err)
+		}
 	}
 	return nil
 }
 
+// fillFromDisk looks up the memory misses on the disk cache, hits are promoted back
+// into memory with their remaining TTL. Returns the positions of the stale hits.
+func (c *machineTranslationCache) fillFromDisk(
+	keys []string, missing []int, resp []model.TargetSegment,
+) (stale []int) {
+	missingKeys := make([]string, len(missing))
+	for i, pos := range missing {
+		missingKeys[i] = keys[pos]
+	}
+	now := time.Now()
+	vals, expiries, found, err := c.disk.get(missingKeys, now)
+	if err != nil {
+		// the disk is only a fallback, treat it as a miss
+		log.Error("disk cache get failed", err)
+		return nil
+	}
+	for i, pos := range missing {
+		if !found[i] {
+			continue
+		}
+		resp[pos] = vals[i]
+		ttl := expiries[i].Sub(now)
+		c.set(missingKeys[i], vals[i], ttl)
+		if c.isStale(ttl) {
+			stale = append(stale, pos)
+		}
+	}
+	return stale
+}
+
+// set stores the segment in memory, its cost accounts for the key kept in the index
+func (c *machineTranslationCache) set(key string, seg model.TargetSegment, ttl time.Duration) {
+	h, _ := z.KeyToHash(key)
+	c.keysMu.Lock()
+	c.keys[h] = key
+	c.keysMu.Unlock()
+
+	if !c.cache.SetWithTTL(key, seg, int64(len(key)+len(seg)), ttl) {
+		// a dropped refresh leaves the previous value in memory, it must stay indexed to be purged
+		if _, live := c.cache.GetTTL(key); !live {
+			c.forget(&ristretto.Item{Key: h})
+		}
+	}
+}
+
+func (c *machineTranslationCache) forget(item *ristretto.Item) {
+	c.keysMu.Lock()
+	delete(c.keys, item.Key)
+	c.keysMu.Unlock()
+}
+
+func (c *machineTranslationCache) indexed(key string) bool {
+	h, _ := z.KeyToHash(key)
+	c.keysMu.Lock()
+	defer c.keysMu.Unlock()
+	_, found := c.keys[h]
+	return found
+}
+
+// indexedKeys is a copy of the index, some keys may have left the cache already
+func (c *machineTranslationCache) indexedKeys() []string {
+	c.keysMu.Lock()
+	defer c.keysMu.Unlock()
+	keys := make([]string, 0, len(c.keys))
+	for _, k := range c.keys {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
 func (c *machineTranslationCache) Metrics() string {
 	return c.cache.Metrics.String()
 }
 
-func keysFor(md model.MTRequestMetadata, segments []string) []string {
+func (c *machineTranslationCache) Close() error {
+	var err error
+	// apply the buffered sets, so they make it into the snapshot
+	c.cache.Wait()
+	if c.config.SnapshotPath != "" {
+		var n int
+		n, err = c.writeSnapshotFile(c.config.SnapshotPath, time.Now())
+		log.WithFields(log.Fields{
+			"path":    c.config.SnapshotPath,
+			"entries": n,
+		}).Info("cache snapshot written")
+	}
+	c.cache.Close()
+	if c.disk != nil {
+		if er := c.disk.close(); er != nil && err == nil {
+			err = er
+		}
+	}
+	return err
+}
+
+// KeysFor returns the cache key of each segment, for the given request metadata
+func KeysFor(md model.MTRequestMetadata, segments []string) []string {
 	var b strings.Builder
-	b.WriteString(md.SourceLang)
-	b.WriteString("|")
-	b.WriteString(md.TargetLang)
-	b.WriteString("|")
+	b.WriteString(languagePairPrefix(md.SourceLang, md.TargetLang))
 	//TODO: fmt is non-ideal on hot-paths
 	b.WriteString(fmt.Sprintf("%+v", md.Metadata))
 	b.WriteString("|")
 	prefix := b.String()
 
 	keys := make([]string, len(segments))
-	for _, v := range segments {
-		keys = append(keys, prefix+v)
+	for i, v := range segments {
+		keys[i] = prefix + v
 	}
 	return keys
 }
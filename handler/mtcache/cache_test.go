@@ -0,0 +1,270 @@
+//go:build unit
+// +build unit
+
+package mtcache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/msf/cachingproxy/model"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+var testMetadata = model.MTRequestMetadata{SourceLang: "en", TargetLang: "pt"}
+
+func lookup(t *testing.T, c MachineTranslationCache, segments ...string) []model.TargetSegment {
+	resp, err := c.Handle(context.Background(), &model.MachineTranslationRequest{Segments: segments, Metadata: testMetadata})
+	assert.Nil(t, err)
+	return resp.TargetSegments
+}
+
+func TestKeysFor(t *testing.T) {
+	keys := KeysFor(testMetadata, []string{"a", "b"})
+	assert.Equal(t, []string{"en|pt|map[]|a", "en|pt|map[]|b"}, keys)
+}
+
+func TestDiskCacheSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{MaxSizeMB: 1, MaxTTL: time.Hour, DiskDir: dir}
+
+	c, err := NewCachingSegmentTranslator(cfg)
+	assert.Nil(t, err)
+	assert.Nil(t, c.Save(testMetadata, []string{"hello", "bye"}, []model.TargetSegment{"olá", "adeus"}))
+	assert.Nil(t, c.Close())
+
+	c, err = NewCachingSegmentTranslator(cfg)
+	assert.Nil(t, err)
+	defer c.Close()
+	assert.Equal(t, []model.TargetSegment{"olá", "", "adeus"}, lookup(t, c, "hello", "other", "bye"))
+
+	// disk hits are promoted into memory
+	mc := c.(*machineTranslationCache)
+	mc.cache.Wait()
+	v, found := mc.cache.Get(KeysFor(testMetadata, []string{"hello"})[0])
+	assert.True(t, found)
+	assert.Equal(t, model.TargetSegment("olá"), v)
+}
+
+func TestDiskCacheExpiry(t *testing.T) {
+	d, err := newDiskCache(t.TempDir(), time.Minute, 0)
+	assert.Nil(t, err)
+	defer d.close()
+
+	now := time.Now()
+	assert.Nil(t, d.set([]string{"a"}, []model.TargetSegment{"A"}, now))
+
+	vals, expiries, found, err := d.get([]string{"a", "b"}, now.Add(time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{true, false}, found)
+	assert.Equal(t, model.TargetSegment("A"), vals[0])
+	assert.Equal(t, now.Add(time.Minute).UnixNano(), expiries[0].UnixNano())
+
+	_, _, found, err = d.get([]string{"a"}, now.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{false}, found)
+
+	removed, err := d.sweep(now.Add(time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, removed)
+	removed, err = d.sweep(now.Add(2 * time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+}
+
+func TestDiskCacheMaxEntries(t *testing.T) {
+	d, err := newDiskCache(t.TempDir(), time.Minute, 3)
+	assert.Nil(t, err)
+	defer d.close()
+
+	now := time.Now()
+	assert.Nil(t, d.set([]string{"a", "b"}, []model.TargetSegment{"A", "B"}, now))
+	assert.Nil(t, d.set([]string{"c"}, []model.TargetSegment{"C"}, now.Add(time.Second)))
+	// refreshing "a" makes "b" the first to expire
+	assert.Nil(t, d.set([]string{"a"}, []model.TargetSegment{"A"}, now.Add(2*time.Second)))
+	assert.Equal(t, 3, d.len())
+
+	assert.Nil(t, d.set([]string{"d"}, []model.TargetSegment{"D"}, now.Add(3*time.Second)))
+	assert.Equal(t, 3, d.len())
+	_, _, found, err := d.get([]string{"a", "b", "c", "d"}, now)
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{true, false, true, true}, found)
+}
+
+func TestDiskCacheSweepsInChunks(t *testing.T) {
+	d, err := newDiskCache(t.TempDir(), time.Minute, 0)
+	assert.Nil(t, err)
+	defer d.close()
+
+	now := time.Now()
+	n := 2*diskDeleteChunk + 10
+	keys, vals := make([]string, n), make([]model.TargetSegment, n)
+	for i := range keys {
+		keys[i], vals[i] = fmt.Sprint("en|pt|", i), "x"
+	}
+	assert.Nil(t, d.set(keys, vals, now))
+	assert.Nil(t, d.set([]string{"fresh"}, []model.TargetSegment{"y"}, now.Add(time.Hour)))
+
+	removed, err := d.sweep(now.Add(2 * time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, n, removed)
+	assert.Equal(t, 1, d.len())
+
+	assert.Nil(t, d.set(keys, vals, now))
+	removed, err = d.deletePrefix("en|pt|")
+	assert.Nil(t, err)
+	assert.Equal(t, n, removed)
+	assert.Equal(t, 1, d.len())
+}
+
+func TestDiskCacheIndexesOlderFiles(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	// written before the expiries bucket existed
+	db, err := bolt.Open(filepath.Join(dir, diskFileName), 0o600, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(segmentsBucket)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("broken"), []byte("x")); err != nil {
+			return err
+		}
+		return b.Put([]byte("a"), encodeValue("A", now.Add(time.Minute)))
+	}))
+	assert.Nil(t, db.Close())
+
+	d, err := newDiskCache(dir, time.Minute, 0)
+	assert.Nil(t, err)
+	defer d.close()
+	assert.Equal(t, 1, d.len())
+	removed, err := d.sweep(now.Add(2 * time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, 0, d.len())
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mtcache.snapshot")
+	cfg := Config{MaxSizeMB: 1, MaxTTL: time.Hour, SnapshotPath: path}
+
+	c, err := NewCachingSegmentTranslator(cfg)
+	assert.Nil(t, err)
+	assert.Nil(t, c.Save(testMetadata, []string{"hello", "bye"}, []model.TargetSegment{"olá", "adeus"}))
+	c.(*machineTranslationCache).cache.Wait()
+	assert.Nil(t, c.Close())
+
+	c, err = NewCachingSegmentTranslator(cfg)
+	assert.Nil(t, err)
+	defer c.Close()
+	assert.Equal(t, []model.TargetSegment{"olá", "", "adeus"}, lookup(t, c, "hello", "other", "bye"))
+
+	ttl, found := c.(*machineTranslationCache).cache.GetTTL(KeysFor(testMetadata, []string{"hello"})[0])
+	assert.True(t, found)
+	assert.True(t, ttl <= time.Hour && ttl > 59*time.Minute, ttl)
+}
+
+func TestSnapshotSkipsExpired(t *testing.T) {
+	c, err := NewCachingSegmentTranslator(Config{MaxSizeMB: 1, MaxTTL: time.Hour})
+	assert.Nil(t, err)
+	defer c.Close()
+	mc := c.(*machineTranslationCache)
+	assert.Nil(t, c.Save(testMetadata, []string{"hello"}, []model.TargetSegment{"olá"}))
+	mc.cache.Wait()
+
+	var buf bytes.Buffer
+	n, err := mc.writeSnapshot(&buf, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	restored, err := NewCachingSegmentTranslator(Config{MaxSizeMB: 1, MaxTTL: time.Hour})
+	assert.Nil(t, err)
+	defer restored.Close()
+	n, err = restored.(*machineTranslationCache).loadSnapshot(&buf, time.Now().Add(2*time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestSnapshotMissingFile(t *testing.T) {
+	c, err := NewCachingSegmentTranslator(Config{
+		MaxSizeMB: 1, MaxTTL: time.Hour, SnapshotPath: filepath.Join(t.TempDir(), "missing"),
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, c.Close())
+}
+
+func TestAdminLookupDeletePurge(t *testing.T) {
+	c, err := NewCachingSegmentTranslator(Config{MaxSizeMB: 1, MaxTTL: time.Hour, DiskDir: t.TempDir()})
+	assert.Nil(t, err)
+	defer c.Close()
+	enDe := model.MTRequestMetadata{SourceLang: "en", TargetLang: "de"}
+	assert.Nil(t, c.Save(testMetadata, []string{"hello", "bye"}, []model.TargetSegment{"olá", "adeus"}))
+	assert.Nil(t, c.Save(enDe, []string{"hello"}, []model.TargetSegment{"hallo"}))
+	c.(*machineTranslationCache).cache.Wait()
+
+	entry, found := c.Lookup(testMetadata, "hello")
+	assert.True(t, found)
+	assert.Equal(t, model.TargetSegment("olá"), entry.Target)
+	assert.Equal(t, TierMemory, entry.Tier)
+	assert.Equal(t, 3, c.Stats().Keys)
+	_, found = c.Lookup(testMetadata, "unknown")
+	assert.False(t, found)
+	assert.Equal(t, uint64(0), c.Stats().Misses)
+
+	assert.Nil(t, c.Delete(testMetadata, []string{"hello"}))
+	_, found = c.Lookup(testMetadata, "hello")
+	assert.False(t, found)
+
+	// "bye" is kept both in memory and on disk
+	purged, err := c.PurgeLanguagePair("en", "pt")
+	assert.Nil(t, err)
+	assert.Equal(t, Purged{Memory: 1, Disk: 1}, purged)
+	_, found = c.Lookup(testMetadata, "bye")
+	assert.False(t, found)
+	entry, found = c.Lookup(enDe, "hello")
+	assert.True(t, found)
+	assert.Equal(t, model.TargetSegment("hallo"), entry.Target)
+}
+
+func TestPurgeAfterDroppedRefresh(t *testing.T) {
+	c, err := NewCachingSegmentTranslator(Config{MaxSizeMB: 1, MaxTTL: time.Hour})
+	assert.Nil(t, err)
+	defer c.Close()
+	mc := c.(*machineTranslationCache)
+	assert.Nil(t, c.Save(testMetadata, []string{"hello"}, []model.TargetSegment{"olá"}))
+	mc.cache.Wait()
+
+	// ristretto drops the sets it can't take, here one that already expired
+	mc.set(KeysFor(testMetadata, []string{"hello"})[0], "oi", -time.Second)
+	_, found := c.Lookup(testMetadata, "hello")
+	assert.True(t, found)
+
+	_, err = c.PurgeLanguagePair("en", "pt")
+	assert.Nil(t, err)
+	_, found = c.Lookup(testMetadata, "hello")
+	assert.False(t, found)
+}
+
+func TestFetchReportsStale(t *testing.T) {
+	c, err := NewCachingSegmentTranslator(Config{MaxSizeMB: 1, MaxTTL: time.Hour, SoftTTL: 30 * time.Minute})
+	assert.Nil(t, err)
+	defer c.Close()
+	mc := c.(*machineTranslationCache)
+	keys := KeysFor(testMetadata, []string{"fresh", "old"})
+	mc.set(keys[0], "novo", time.Hour)
+	mc.set(keys[1], "velho", 20*time.Minute) // saved 40 minutes ago
+	mc.cache.Wait()
+
+	resp, stale, err := c.Fetch(context.Background(), &model.MachineTranslationRequest{
+		Segments: []string{"missing", "fresh", "old"}, Metadata: testMetadata,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []model.TargetSegment{"", "novo", "velho"}, resp.TargetSegments)
+	assert.Equal(t, []int{2}, stale)
+}
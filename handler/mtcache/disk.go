@@ -0,0 +1,321 @@
+package mtcache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/msf/cachingproxy/model"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	diskFileName = "mtcache.db"
+	// expired entries are never returned, the sweep only reclaims their space
+	diskSweepInterval = 10 * time.Minute
+	// diskDeleteChunk bounds the entries removed per write transaction by the sweeps and purges,
+	// so the writers aren't blocked for long
+	diskDeleteChunk  = 1000
+	expiryHeaderSize = 8
+)
+
+var (
+	segmentsBucket = []byte("segments")
+	// expiriesBucket indexes the segments by expiry, its keys are the segment expiry header
+	// followed by the segment key, with empty values
+	expiriesBucket = []byte("expiries")
+)
+
+// diskCache is the persistent second level of the cache, a bbolt file under Config.DiskDir.
+// Values are stored with their expiry time: unix nanos (8 bytes, big endian) + segment.
+type diskCache struct {
+	// entries counts the segments stored, kept first for the 64 bit atomics alignment
+	entries int64
+
+	db  *bolt.DB
+	ttl time.Duration
+	// maxEntries bounds the segments stored, the ones expiring first are evicted. Concurrent
+	// writes may overshoot it slightly until the next one. Zero is unlimited.
+	maxEntries int
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+func newDiskCache(dir string, ttl time.Duration, maxEntries int) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("disk cache dir: %w", err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, diskFileName), 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("disk cache open: %w", err)
+	}
+	d := &diskCache{
+		db:         db,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	if err = db.Update(d.init); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("disk cache init: %w", err)
+	}
+	go d.sweepLoop(diskSweepInterval)
+	return d, nil
+}
+
+// init creates the buckets and counts the entries, indexing them by expiry when the file
+// was written before the expiries bucket existed
+func (d *diskCache) init(tx *bolt.Tx) error {
+	segments, err := tx.CreateBucketIfNotExists(segmentsBucket)
+	if err != nil {
+		return err
+	}
+	if tx.Bucket(expiriesBucket) == nil {
+		expiries, err := tx.CreateBucket(expiriesBucket)
+		if err != nil {
+			return err
+		}
+		var broken [][]byte
+		err = segments.ForEach(func(k, v []byte) error {
+			if len(v) < expiryHeaderSize {
+				broken = append(broken, append([]byte(nil), k...))
+				return nil
+			}
+			d.entries++
+			return expiries.Put(expiryKey(v, k), nil)
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range broken {
+			if err := segments.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	d.entries = int64(segments.Stats().KeyN)
+	return nil
+}
+
+// get looks up the keys in a single transaction, found[i] is false for missing or expired keys
+func (d *diskCache) get(keys []string, now time.Time) (
+	vals []model.TargetSegment, expiries []time.Time, found []bool, err error,
+) {
+	vals = make([]model.TargetSegment, len(keys))
+	expiries = make([]time.Time, len(keys))
+	found = make([]bool, len(keys))
+	err = d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(segmentsBucket)
+		for i, k := range keys {
+			v := b.Get([]byte(k))
+			if len(v) < expiryHeaderSize {
+				continue
+			}
+			expiry := decodeExpiry(v)
+			if !expiry.After(now) {
+				continue
+			}
+			// v is only valid during the transaction, string() copies it
+			vals[i] = model.TargetSegment(v[expiryHeaderSize:])
+			expiries[i] = expiry
+			found[i] = true
+		}
+		return nil
+	})
+	return vals, expiries, found, err
+}
+
+// set stores the segments, evicting the ones expiring first when over maxEntries
+func (d *diskCache) set(keys []string, vals []model.TargetSegment, now time.Time) error {
+	expiry := now.Add(d.ttl)
+	// Batch coalesces concurrent writers into fewer fsyncs
+	return d.db.Batch(func(tx *bolt.Tx) error {
+		segments, expiries := tx.Bucket(segmentsBucket), tx.Bucket(expiriesBucket)
+		added := 0
+		for i, k := range keys {
+			key := []byte(k)
+			if old := segments.Get(key); old == nil {
+				added++
+			} else if err := expiries.Delete(expiryKey(old, key)); err != nil {
+				return err
+			}
+			v := encodeValue(vals[i], expiry)
+			if err := segments.Put(key, v); err != nil {
+				return err
+			}
+			if err := expiries.Put(expiryKey(v, key), nil); err != nil {
+				return err
+			}
+		}
+		d.countOnCommit(tx, added)
+		if over := int(atomic.LoadInt64(&d.entries)) + added - d.maxEntries; d.maxEntries > 0 && over > 0 {
+			_, err := d.deleteFirst(tx, over, nil)
+			return err
+		}
+		return nil
+	})
+}
+
+func (d *diskCache) delete(keys []string) error {
+	return d.db.Batch(func(tx *bolt.Tx) error {
+		segments, expiries := tx.Bucket(segmentsBucket), tx.Bucket(expiriesBucket)
+		removed := 0
+		for _, k := range keys {
+			key := []byte(k)
+			old := segments.Get(key)
+			if old == nil {
+				continue
+			}
+			if err := expiries.Delete(expiryKey(old, key)); err != nil {
+				return err
+			}
+			if err := segments.Delete(key); err != nil {
+				return err
+			}
+			removed++
+		}
+		d.countOnCommit(tx, -removed)
+		return nil
+	})
+}
+
+// deletePrefix removes every key starting with prefix, returning how many were removed
+func (d *diskCache) deletePrefix(prefix string) (removed int, err error) {
+	for {
+		n := 0
+		err = d.db.Update(func(tx *bolt.Tx) error {
+			segments, expiries := tx.Bucket(segmentsBucket), tx.Bucket(expiriesBucket)
+			// deleting while iterating a cursor skips items, so collect first
+			var matched [][]byte
+			c := segments.Cursor()
+			for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+				if len(matched) == diskDeleteChunk {
+					break
+				}
+				matched = append(matched, expiryKey(v, k))
+			}
+			for _, ek := range matched {
+				if err := expiries.Delete(ek); err != nil {
+					return err
+				}
+				if err := segments.Delete(ek[expiryHeaderSize:]); err != nil {
+					return err
+				}
+			}
+			n = len(matched)
+			d.countOnCommit(tx, -n)
+			return nil
+		})
+		removed += n
+		if err != nil || n < diskDeleteChunk {
+			return removed, err
+		}
+	}
+}
+
+// sweep deletes the expired entries, returning how many were removed
+func (d *diskCache) sweep(now time.Time) (removed int, err error) {
+	expired := func(expiry time.Time) bool { return !expiry.After(now) }
+	for {
+		n := 0
+		err = d.db.Update(func(tx *bolt.Tx) error {
+			var err error
+			n, err = d.deleteFirst(tx, diskDeleteChunk, expired)
+			return err
+		})
+		removed += n
+		if err != nil || n < diskDeleteChunk {
+			return removed, err
+		}
+	}
+}
+
+// deleteFirst removes up to limit of the entries expiring first, as long as they match
+// when set, returning how many were removed
+func (d *diskCache) deleteFirst(tx *bolt.Tx, limit int, match func(expiry time.Time) bool) (int, error) {
+	segments, expiries := tx.Bucket(segmentsBucket), tx.Bucket(expiriesBucket)
+	// deleting while iterating a cursor skips items, so collect first
+	var matched [][]byte
+	c := expiries.Cursor()
+	for k, _ := c.First(); k != nil && len(matched) < limit; k, _ = c.Next() {
+		if match != nil && !match(decodeExpiry(k)) {
+			break
+		}
+		matched = append(matched, append([]byte(nil), k...))
+	}
+	for _, ek := range matched {
+		if err := expiries.Delete(ek); err != nil {
+			return 0, err
+		}
+		if err := segments.Delete(ek[expiryHeaderSize:]); err != nil {
+			return 0, err
+		}
+	}
+	d.countOnCommit(tx, -len(matched))
+	return len(matched), nil
+}
+
+// countOnCommit adds delta to the entries once tx is committed, Batch may roll it back and retry
+func (d *diskCache) countOnCommit(tx *bolt.Tx, delta int) {
+	if delta != 0 {
+		tx.OnCommit(func() { atomic.AddInt64(&d.entries, int64(delta)) })
+	}
+}
+
+// len is how many entries are stored, expired ones included until swept
+func (d *diskCache) len() int {
+	return int(atomic.LoadInt64(&d.entries))
+}
+
+func (d *diskCache) sweepLoop(interval time.Duration) {
+	defer close(d.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case now := <-ticker.C:
+			removed, err := d.sweep(now)
+			if err != nil {
+				log.Error("disk cache sweep failed", err)
+				continue
+			}
+			log.WithFields(log.Fields{
+				"removed": removed,
+			}).Debug("disk cache sweep")
+		}
+	}
+}
+
+func (d *diskCache) close() error {
+	close(d.stop)
+	<-d.done
+	return d.db.Close()
+}
+
+func encodeValue(seg model.TargetSegment, expiry time.Time) []byte {
+	v := make([]byte, expiryHeaderSize+len(seg))
+	binary.BigEndian.PutUint64(v, uint64(expiry.UnixNano()))
+	copy(v[expiryHeaderSize:], seg)
+	return v
+}
+
+// expiryKey is the expiriesBucket key of the segment key, stored with value v
+func expiryKey(v, key []byte) []byte {
+	k := make([]byte, expiryHeaderSize+len(key))
+	copy(k, v[:expiryHeaderSize])
+	copy(k[expiryHeaderSize:], key)
+	return k
+}
+
+func decodeExpiry(v []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(v[:expiryHeaderSize])))
+}
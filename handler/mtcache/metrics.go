@@ -0,0 +1,63 @@
+package mtcache
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// statsCollector exports the ristretto metrics of a cache on each prometheus scrape
+type statsCollector struct {
+	cache MachineTranslationCache
+
+	hits        *prometheus.Desc
+	misses      *prometheus.Desc
+	keysAdded   *prometheus.Desc
+	keysEvicted *prometheus.Desc
+	costAdded   *prometheus.Desc
+	costEvicted *prometheus.Desc
+	keys        *prometheus.Desc
+	cost        *prometheus.Desc
+}
+
+// NewStatsCollector returns a prometheus.Collector for the cache Stats
+func NewStatsCollector(cache MachineTranslationCache) prometheus.Collector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName("mtproxy", "cache", name), help, nil, nil)
+	}
+	return &statsCollector{
+		cache:       cache,
+		hits:        desc("hits_total", "Memory cache hits."),
+		misses:      desc("misses_total", "Memory cache misses."),
+		keysAdded:   desc("keys_added_total", "Keys added to the memory cache."),
+		keysEvicted: desc("keys_evicted_total", "Keys evicted from the memory cache."),
+		costAdded:   desc("cost_added_bytes_total", "Cost added to the memory cache."),
+		costEvicted: desc("cost_evicted_bytes_total", "Cost evicted from the memory cache."),
+		keys:        desc("keys", "Keys currently in the memory cache."),
+		cost:        desc("cost_bytes", "Cost currently in the memory cache, added minus evicted."),
+	}
+}
+
+func (s *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.hits
+	ch <- s.misses
+	ch <- s.keysAdded
+	ch <- s.keysEvicted
+	ch <- s.costAdded
+	ch <- s.costEvicted
+	ch <- s.keys
+	ch <- s.cost
+}
+
+func (s *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	st := s.cache.Stats()
+	counter := func(d *prometheus.Desc, v uint64) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, float64(v))
+	}
+	counter(s.hits, st.Hits)
+	counter(s.misses, st.Misses)
+	counter(s.keysAdded, st.KeysAdded)
+	counter(s.keysEvicted, st.KeysEvicted)
+	counter(s.costAdded, st.CostAdded)
+	counter(s.costEvicted, st.CostEvicted)
+	ch <- prometheus.MustNewConstMetric(s.keys, prometheus.GaugeValue, float64(st.Keys))
+	ch <- prometheus.MustNewConstMetric(s.cost, prometheus.GaugeValue, float64(st.CostAdded)-float64(st.CostEvicted))
+}
@@ -0,0 +1,143 @@
+package mtcache
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/msf/cachingproxy/model"
+)
+
+const snapshotVersion = 1
+
+// snapshot files are gzipped gob streams: a snapshotHeader followed by Count snapshotEntry
+type snapshotHeader struct {
+	Version   int
+	CreatedAt int64 // unix nanos
+	Count     int
+}
+
+type snapshotEntry struct {
+	Key       string
+	Segment   model.TargetSegment
+	ExpiresAt int64 // unix nanos
+}
+
+// writeSnapshot writes the live entries of the memory cache with their expiry time
+func (c *machineTranslationCache) writeSnapshot(w io.Writer, now time.Time) (int, error) {
+	keys := c.indexedKeys()
+	entries := make([]snapshotEntry, 0, len(keys))
+	for _, k := range keys {
+		v, found := c.cache.Get(k)
+		if !found {
+			continue
+		}
+		ttl, found := c.cache.GetTTL(k)
+		if !found || ttl <= 0 {
+			continue
+		}
+		entries = append(entries, snapshotEntry{
+			Key:       k,
+			Segment:   v.(model.TargetSegment),
+			ExpiresAt: now.Add(ttl).UnixNano(),
+		})
+	}
+
+	zw := gzip.NewWriter(w)
+	enc := gob.NewEncoder(zw)
+	err := enc.Encode(snapshotHeader{
+		Version:   snapshotVersion,
+		CreatedAt: now.UnixNano(),
+		Count:     len(entries),
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i := range entries {
+		if err := enc.Encode(&entries[i]); err != nil {
+			return i, err
+		}
+	}
+	return len(entries), zw.Close()
+}
+
+// loadSnapshot restores the entries that haven't expired yet, with their remaining TTL
+func (c *machineTranslationCache) loadSnapshot(r io.Reader, now time.Time) (int, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+	dec := gob.NewDecoder(zr)
+
+	var header snapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		return 0, err
+	}
+	if header.Version != snapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version %v", header.Version)
+	}
+
+	loaded := 0
+	for i := 0; i < header.Count; i++ {
+		var e snapshotEntry
+		if err := dec.Decode(&e); err != nil {
+			return loaded, err
+		}
+		ttl := time.Unix(0, e.ExpiresAt).Sub(now)
+		if ttl <= 0 {
+			continue
+		}
+		c.set(e.Key, e.Segment, ttl)
+		loaded++
+	}
+	c.cache.Wait()
+	return loaded, nil
+}
+
+// writeSnapshotFile replaces path atomically, so a crash never leaves a truncated snapshot
+func (c *machineTranslationCache) writeSnapshotFile(path string, now time.Time) (int, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	bw := bufio.NewWriter(tmp)
+	n, err := c.writeSnapshot(bw, now)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if er := tmp.Close(); err == nil {
+		err = er
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cache snapshot write: %w", err)
+	}
+	return n, os.Rename(tmp.Name(), path)
+}
+
+func (c *machineTranslationCache) loadSnapshotFile(path string, now time.Time) (int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n, err := c.loadSnapshot(bufio.NewReader(f), now)
+	if err != nil {
+		return n, fmt.Errorf("cache snapshot %v: %w", path, err)
+	}
+	return n, nil
+}
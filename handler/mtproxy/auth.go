@@ -0,0 +1,83 @@
+package mtproxy
+
+import (
+	"fmt"
+
+	"github.com/msf/cachingproxy/clients/maestro"
+)
+
+// Authentication strategies of the routes, the routes without one use the maestro basic auth flags
+const (
+	AuthBasic     = "basic"
+	AuthBearer    = "bearer"
+	AuthTokenFile = "token_file"
+	AuthMTLS      = "mtls"
+)
+
+// AuthConfig is how a route authenticates to its maestro endpoints, the secrets are redacted
+// from the logs
+type AuthConfig struct {
+	Type string `mapstructure:"type" json:"type"`
+	// basic
+	Username string         `mapstructure:"username" json:"username,omitempty"`
+	Password maestro.Secret `mapstructure:"password" json:"password,omitempty"`
+	// bearer
+	Token maestro.Secret `mapstructure:"token" json:"token,omitempty"`
+	// token_file, read again whenever it changes
+	TokenFile string `mapstructure:"token_file" json:"token_file,omitempty"`
+	// mtls, CAFile is optional and defaults to the system roots
+	CertFile string `mapstructure:"cert_file" json:"cert_file,omitempty"`
+	KeyFile  string `mapstructure:"key_file" json:"key_file,omitempty"`
+	CAFile   string `mapstructure:"ca_file" json:"ca_file,omitempty"`
+}
+
+func (c AuthConfig) String() string {
+	switch c.Type {
+	case AuthBasic:
+		return fmt.Sprintf("%v(%v)", c.Type, c.Username)
+	case AuthTokenFile:
+		return fmt.Sprintf("%v(%v)", c.Type, c.TokenFile)
+	case AuthMTLS:
+		return fmt.Sprintf("%v(%v)", c.Type, c.CertFile)
+	}
+	return c.Type
+}
+
+func (c AuthConfig) validate() error {
+	switch c.Type {
+	case AuthBasic:
+		if c.Username == "" || c.Password == "" {
+			return fmt.Errorf("basic auth needs username and password")
+		}
+	case AuthBearer:
+		if c.Token == "" {
+			return fmt.Errorf("bearer auth needs a token")
+		}
+	case AuthTokenFile:
+		if c.TokenFile == "" {
+			return fmt.Errorf("token_file auth needs a token_file")
+		}
+	case AuthMTLS:
+		if c.CertFile == "" || c.KeyFile == "" {
+			return fmt.Errorf("mtls auth needs cert_file and key_file")
+		}
+	default:
+		return fmt.Errorf("unknown auth type %q", c.Type)
+	}
+	return nil
+}
+
+// auth builds the maestro.Auth, reading the token or certificate files
+func (c AuthConfig) auth() (maestro.Auth, error) {
+	switch c.Type {
+	case AuthBasic:
+		return maestro.BasicAuth{Username: c.Username, Password: c.Password}, nil
+	case AuthBearer:
+		return maestro.BearerToken{Token: c.Token}, nil
+	case AuthTokenFile:
+		return maestro.NewFileToken(c.TokenFile)
+	case AuthMTLS:
+		return maestro.NewMTLS(c.CertFile, c.KeyFile, c.CAFile)
+	}
+	return nil, c.validate()
+}
@@ -0,0 +1,99 @@
+//go:build unit
+// +build unit
+
+package mtproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/msf/cachingproxy/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoutesAuthenticateWithTheirOwnCredentials(t *testing.T) {
+	auths := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Text           string `json:"text"`
+			TargetLanguage string `json:"target_language"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		auths[req.TargetLanguage] = r.Header.Get("Authorization")
+		fmt.Fprintf(w, `{"translated_data": {"nuggets": [{"position": 0, "text": %q, "mt_text": "ok"}]}}`, req.Text)
+	}))
+	defer server.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("file-token\n"), 0o600))
+
+	routes, err := NewRoutingMap([]RouteConfig{
+		{TargetLang: "pt", Host: server.URL},
+		{TargetLang: "de", Endpoints: []Endpoint{{Host: server.URL + "/de"}},
+			Auth: &AuthConfig{Type: AuthBearer, Token: "static-token"}},
+		{TargetLang: "fr", Endpoints: []Endpoint{{Host: server.URL + "/fr"}},
+			Auth: &AuthConfig{Type: AuthTokenFile, TokenFile: tokenFile}},
+	})
+	assert.Nil(t, err)
+	p, err := NewMaestroProxyTranslator(Config{Routes: routes, MaestroUsername: "user", MaestroPassword: "pass"})
+	assert.Nil(t, err)
+
+	for _, lang := range []string{"pt", "de", "fr"} {
+		_, err := p.Handle(context.Background(), &model.MachineTranslationRequest{
+			Segments: []string{"Hello."},
+			Metadata: model.MTRequestMetadata{SourceLang: "en", TargetLang: lang},
+		})
+		assert.Nil(t, err, lang)
+	}
+	assert.Equal(t, map[string]string{
+		"pt": "Basic dXNlcjpwYXNz",
+		"de": "Bearer static-token",
+		"fr": "Bearer file-token",
+	}, auths)
+}
+
+func TestRoutesWithoutAuthNeedDefaultCredentials(t *testing.T) {
+	routes := map[RoutingKey]Route{
+		{TargetLang: "de"}: {Endpoints: []Endpoint{{Host: "de.foo", Weight: 1}},
+			Auth: &AuthConfig{Type: AuthBearer, Token: "t"}},
+	}
+	_, err := NewMaestroProxyTranslator(Config{Routes: routes})
+	assert.Nil(t, err)
+
+	routes[RoutingKey{TargetLang: "pt"}] = hostRoute("pt.foo")
+	_, err = NewMaestroProxyTranslator(Config{Routes: routes})
+	assert.NotNil(t, err)
+}
+
+func TestRoutesSharingHostNeedSameAuth(t *testing.T) {
+	routes := map[RoutingKey]Route{
+		{TargetLang: "de"}: {Endpoints: []Endpoint{{Host: "mt.foo", Weight: 1}},
+			Auth: &AuthConfig{Type: AuthBearer, Token: "t"}},
+		{TargetLang: "pt"}: hostRoute("mt.foo"),
+	}
+	_, err := NewMaestroProxyTranslator(Config{Routes: routes, MaestroUsername: "user", MaestroPassword: "pass"})
+	assert.ErrorContains(t, err, "mt.foo")
+
+	routes[RoutingKey{TargetLang: "pt"}] = Route{Endpoints: []Endpoint{{Host: "mt.foo", Weight: 1}},
+		Auth: &AuthConfig{Type: AuthBearer, Token: "t"}}
+	_, err = NewMaestroProxyTranslator(Config{Routes: routes, MaestroUsername: "user", MaestroPassword: "pass"})
+	assert.Nil(t, err)
+}
+
+func TestAuthConfigRedactsSecrets(t *testing.T) {
+	routes := map[RoutingKey]Route{{}: {
+		Endpoints: []Endpoint{{Host: "a.foo"}},
+		Auth:      &AuthConfig{Type: AuthBasic, Username: "user", Password: "hunter2"},
+	}}
+	assert.NotContains(t, fmt.Sprint(routes), "hunter2")
+	assert.NotContains(t, fmt.Sprintf("%+v", *routes[RoutingKey{}].Auth), "hunter2")
+	assert.NotContains(t, fmt.Sprintf("%#v", *routes[RoutingKey{}].Auth), "hunter2")
+	encoded, err := json.Marshal(routes[RoutingKey{}])
+	assert.Nil(t, err)
+	assert.NotContains(t, string(encoded), "hunter2")
+}
@@ -0,0 +1,156 @@
+package mtproxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/msf/cachingproxy/handler"
+)
+
+// BreakerConfig configures the circuit breaker of each maestro hostname
+type BreakerConfig struct {
+	// FailureThreshold consecutive failures open the breaker, zero disables it
+	FailureThreshold int
+	// Cooldown is how long the breaker stays open before letting a probe request through
+	Cooldown time.Duration
+	// SuccessThreshold consecutive successful probes close the breaker again
+	SuccessThreshold int
+	// CacheOnly answers from the cache alone while open, as if the requests allowed
+	// partial responses. Otherwise requests with cache misses fail fast.
+	CacheOnly bool
+}
+
+type breakerState int
+
+// the values are exported as the mtproxy_circuit_breaker_state gauge
+const (
+	breakerClosed   breakerState = 0
+	breakerHalfOpen breakerState = 1
+	breakerOpen     breakerState = 2
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerHalfOpen:
+		return "half_open"
+	}
+	return "open"
+}
+
+type breakerResult int
+
+const (
+	// the host replied, even if it rejected the request
+	breakerSuccess breakerResult = iota
+	breakerFailure
+	// the request was given up by the caller, it says nothing about the host
+	breakerIgnored
+)
+
+// circuitBreaker stops sending requests to a failing host. Once open, it fails every
+// request for Cooldown, then lets one probe request at a time through (half open) until
+// SuccessThreshold of them succeed, closing it, or one fails, opening it again.
+type circuitBreaker struct {
+	host   string
+	config BreakerConfig
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	successes int
+	openedAt  time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(host string, config BreakerConfig) *circuitBreaker {
+	if config.SuccessThreshold < 1 {
+		config.SuccessThreshold = 1
+	}
+	b := &circuitBreaker{host: host, config: config}
+	breakerStateGauge.WithLabelValues(host).Set(float64(breakerClosed))
+	return b
+}
+
+// allow returns handler.ErrUpstreamUnavailable when the request must not be sent,
+// otherwise done must be called with its result.
+func (b *circuitBreaker) allow(now time.Time) error {
+	if b.config.FailureThreshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && now.Sub(b.openedAt) >= b.config.Cooldown {
+		b.setState(breakerHalfOpen)
+	}
+	switch {
+	case b.state == breakerOpen, b.state == breakerHalfOpen && b.probing:
+		breakerRejectedCounter.WithLabelValues(b.host).Inc()
+		return handler.ErrUpstreamUnavailable
+	case b.state == breakerHalfOpen:
+		b.probing = true
+	}
+	return nil
+}
+
+// rejects is true when allow would fail, without letting a probe through
+func (b *circuitBreaker) rejects(now time.Time) bool {
+	if b.config.FailureThreshold <= 0 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		return now.Sub(b.openedAt) < b.config.Cooldown
+	case breakerHalfOpen:
+		return b.probing
+	}
+	return false
+}
+
+func (b *circuitBreaker) done(result breakerResult, now time.Time) {
+	if b.config.FailureThreshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	halfOpen := b.state == breakerHalfOpen
+	if halfOpen {
+		b.probing = false
+	}
+	switch result {
+	case breakerSuccess:
+		b.failures = 0
+		if halfOpen {
+			b.successes++
+			if b.successes >= b.config.SuccessThreshold {
+				b.setState(breakerClosed)
+			}
+		}
+	case breakerFailure:
+		b.failures++
+		if halfOpen || (b.state == breakerClosed && b.failures >= b.config.FailureThreshold) {
+			b.openedAt = now
+			b.setState(breakerOpen)
+		}
+	}
+}
+
+// setState must be called with mu held
+func (b *circuitBreaker) setState(s breakerState) {
+	b.state = s
+	b.failures, b.successes = 0, 0
+	breakerStateGauge.WithLabelValues(b.host).Set(float64(s))
+	breakerTransitionsCounter.WithLabelValues(b.host, s.String()).Inc()
+}
+
+// newBreakers builds a circuitBreaker for each of the hostnames
+func newBreakers(hostnames []string, config BreakerConfig) map[string]*circuitBreaker {
+	breakers := make(map[string]*circuitBreaker, len(hostnames))
+	for _, hostname := range hostnames {
+		breakers[hostname] = newCircuitBreaker(hostname, config)
+	}
+	return breakers
+}
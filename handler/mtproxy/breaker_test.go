@@ -0,0 +1,78 @@
+//go:build unit
+// +build unit
+
+package mtproxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/msf/cachingproxy/handler"
+	"github.com/msf/cachingproxy/model"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	b := newCircuitBreaker("breaker.test", BreakerConfig{
+		FailureThreshold: 2, Cooldown: time.Minute, SuccessThreshold: 2,
+	})
+	now := time.Now()
+	state := func() float64 { return testutil.ToFloat64(breakerStateGauge.WithLabelValues("breaker.test")) }
+
+	// a success in between resets the consecutive failures
+	for _, r := range []breakerResult{breakerFailure, breakerSuccess, breakerFailure, breakerIgnored} {
+		assert.Nil(t, b.allow(now))
+		b.done(r, now)
+	}
+	assert.Equal(t, float64(breakerClosed), state())
+
+	assert.Nil(t, b.allow(now))
+	b.done(breakerFailure, now)
+	assert.Equal(t, float64(breakerOpen), state())
+	assert.ErrorIs(t, b.allow(now.Add(time.Second)), handler.ErrUpstreamUnavailable)
+
+	// after the cooldown, a single probe at a time
+	now = now.Add(time.Minute)
+	assert.Nil(t, b.allow(now))
+	assert.Equal(t, float64(breakerHalfOpen), state())
+	assert.ErrorIs(t, b.allow(now), handler.ErrUpstreamUnavailable)
+	b.done(breakerFailure, now)
+	assert.Equal(t, float64(breakerOpen), state())
+
+	now = now.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, b.allow(now))
+		b.done(breakerSuccess, now)
+	}
+	assert.Equal(t, float64(breakerClosed), state())
+	assert.Nil(t, b.allow(now))
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b := newCircuitBreaker("disabled.test", BreakerConfig{})
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, b.allow(time.Now()))
+		b.done(breakerFailure, time.Now())
+	}
+}
+
+func TestHandleFailsFastWithOpenBreaker(t *testing.T) {
+	client := &fakeMaestro{err: errors.New("giving up after 3 attempt(s)")}
+	p := newMaestroProxyTranslator(client, Config{
+		Routes:  map[RoutingKey]Route{{SourceLang: "en", TargetLang: "pt"}: hostRoute("open.foo")},
+		Breaker: BreakerConfig{FailureThreshold: 2, Cooldown: time.Minute},
+	})
+	md := model.MTRequestMetadata{SourceLang: "en", TargetLang: "pt"}
+
+	for i := 0; i < 3; i++ {
+		_, err := p.Handle(context.Background(), &model.MachineTranslationRequest{Segments: []string{"Hello."}, Metadata: md})
+		assert.NotNil(t, err)
+	}
+	_, err := p.Handle(context.Background(), &model.MachineTranslationRequest{Segments: []string{"Hello."}, Metadata: md})
+	assert.ErrorIs(t, err, handler.ErrUpstreamUnavailable)
+	assert.Equal(t, handler.CodeUpstreamUnavailable, handler.ErrorCode(err))
+	assert.Equal(t, 2, client.calls)
+}
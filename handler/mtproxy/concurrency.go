@@ -0,0 +1,39 @@
+package mtproxy
+
+import (
+	"context"
+)
+
+// routeLimiter bounds the concurrent maestro requests of a route, whatever endpoint they go to
+type routeLimiter struct {
+	// nil when unlimited
+	slots chan struct{}
+}
+
+// newRouteLimiter allows limit concurrent requests, zero is unlimited
+func newRouteLimiter(limit int) *routeLimiter {
+	l := &routeLimiter{}
+	if limit > 0 {
+		l.slots = make(chan struct{}, limit)
+	}
+	return l
+}
+
+// acquire waits for a free slot, until ctx is done. release must be called after.
+func (l *routeLimiter) acquire(ctx context.Context) error {
+	if l.slots == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *routeLimiter) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
@@ -0,0 +1,89 @@
+//go:build unit
+// +build unit
+
+package mtproxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/msf/cachingproxy/clients/maestro"
+	"github.com/msf/cachingproxy/model"
+	mmodel "github.com/msf/cachingproxy/model/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteLimiter(t *testing.T) {
+	l := newRouteLimiter(1)
+	assert.Nil(t, l.acquire(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, l.acquire(ctx), context.DeadlineExceeded)
+
+	l.release()
+	assert.Nil(t, l.acquire(context.Background()))
+}
+
+func TestRouteLimiterUnlimited(t *testing.T) {
+	l := newRouteLimiter(0)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, l.acquire(context.Background()))
+	}
+	l.release()
+}
+
+// blockingMaestro holds the requests to blockLang until they are cancelled
+type blockingMaestro struct {
+	maestro.Maestro
+	blockLang string
+	blocked   chan struct{}
+}
+
+func (f *blockingMaestro) MachineTranslate(
+	ctx context.Context, serviceURL string, req *mmodel.MTRequest) (*mmodel.MTResponse, error) {
+	if req.TargetLanguage == f.blockLang {
+		f.blocked <- struct{}{}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return &mmodel.MTResponse{TranslatedData: mmodel.TranslatedData{
+		Nuggets: []mmodel.Nugget{{Position: 0, Text: req.Text, MTText: req.Text}},
+	}}, nil
+}
+
+func TestRoutesSharingHostHaveTheirOwnSlots(t *testing.T) {
+	client := &blockingMaestro{blockLang: "pt", blocked: make(chan struct{}, 1)}
+	p := newMaestroProxyTranslator(client, Config{
+		Routes: map[RoutingKey]Route{
+			{TargetLang: "pt"}: hostRoute("shared.local"),
+			{TargetLang: "de"}: hostRoute("shared.local"),
+		},
+		MaxRouteConcurrency: 1,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Handle(ctx, &model.MachineTranslationRequest{
+		Segments: []string{"Hello."},
+		Metadata: model.MTRequestMetadata{SourceLang: "en", TargetLang: "pt"},
+	})
+	<-client.blocked
+
+	// the pt route has no slot left, de has its own
+	deCtx, cancelDe := context.WithTimeout(context.Background(), time.Second)
+	defer cancelDe()
+	_, err := p.Handle(deCtx, &model.MachineTranslationRequest{
+		Segments: []string{"Hello."},
+		Metadata: model.MTRequestMetadata{SourceLang: "en", TargetLang: "de"},
+	})
+	assert.Nil(t, err)
+
+	ptCtx, cancelPt := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelPt()
+	_, err = p.Handle(ptCtx, &model.MachineTranslationRequest{
+		Segments: []string{"Bye."},
+		Metadata: model.MTRequestMetadata{SourceLang: "en", TargetLang: "pt"},
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
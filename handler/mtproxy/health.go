@@ -0,0 +1,103 @@
+package mtproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HealthCheckConfig configures the active health checks of the maestro hosts, an
+// unhealthy host is pulled out of rotation of the routes with other endpoints
+type HealthCheckConfig struct {
+	// Path is requested on every host, any 2XX reply is healthy. Empty disables the checks.
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+	// consecutive checks marking a host unhealthy or healthy again
+	UnhealthyThreshold int
+	HealthyThreshold   int
+}
+
+func (c HealthCheckConfig) enabled() bool {
+	return c.Path != "" && c.Interval > 0
+}
+
+// startHealthChecks checks every upstream each Interval, until the returned stop is called
+func (ups *upstreams) startHealthChecks(config HealthCheckConfig) (stop func()) {
+	if config.UnhealthyThreshold < 1 {
+		config.UnhealthyThreshold = 1
+	}
+	if config.HealthyThreshold < 1 {
+		config.HealthyThreshold = 1
+	}
+	if config.Timeout <= 0 || config.Timeout > config.Interval {
+		config.Timeout = config.Interval
+	}
+	client := &http.Client{Timeout: config.Timeout}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, u := range ups.byHost {
+		wg.Add(1)
+		go func(u *upstream) {
+			defer wg.Done()
+			ticker := time.NewTicker(config.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					u.checked(config, checkHealth(ctx, client, u.host, config.Path))
+				}
+			}
+		}(u)
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+func checkHealth(ctx context.Context, client *http.Client, host, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serviceURL(host)+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("health check replied %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// checked records a health check outcome, flipping healthy once a threshold is reached
+func (u *upstream) checked(config HealthCheckConfig, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err != nil {
+		u.checkSuccesses = 0
+		u.checkFailures++
+		if u.healthy && u.checkFailures >= config.UnhealthyThreshold {
+			u.healthy = false
+			endpointHealthyGauge.WithLabelValues(u.host).Set(0)
+			log.WithField("host", u.host).Warn("maestro host unhealthy: ", err)
+		}
+		return
+	}
+	u.checkFailures = 0
+	u.checkSuccesses++
+	if !u.healthy && u.checkSuccesses >= config.HealthyThreshold {
+		u.healthy = true
+		endpointHealthyGauge.WithLabelValues(u.host).Set(1)
+		log.WithField("host", u.host).Info("maestro host healthy again")
+	}
+}
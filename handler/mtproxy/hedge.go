@@ -0,0 +1,164 @@
+package mtproxy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/msf/cachingproxy/model"
+)
+
+// HedgeConfig sends a second request for the same translation when the first one is slow,
+// to another endpoint of the route. The first response wins and the other request is cancelled.
+// Routes with a single endpoint, or no other usable one, aren't hedged.
+type HedgeConfig struct {
+	// Delay before hedging a request, zero disables hedging unless Percentile is set
+	Delay time.Duration `mapstructure:"delay" json:"delay,omitempty"`
+	// Percentile of the latencies observed on the host, e.g. 0.95, replaces Delay once
+	// the host answered MinSamples requests. Zero uses Delay only.
+	Percentile float64 `mapstructure:"percentile" json:"percentile,omitempty"`
+	MinSamples int     `mapstructure:"min_samples" json:"min_samples,omitempty"`
+	// MinDelay floors the observed delay, so fast hosts aren't hedged on every hiccup
+	MinDelay time.Duration `mapstructure:"min_delay" json:"min_delay,omitempty"`
+}
+
+func (c HedgeConfig) validate() error {
+	switch {
+	case c.Delay < 0 || c.MinDelay < 0:
+		return fmt.Errorf("hedge: negative delay")
+	case c.Percentile < 0 || c.Percentile >= 1:
+		return fmt.Errorf("hedge: percentile must be within [0, 1)")
+	case c.MinSamples < 0:
+		return fmt.Errorf("hedge: negative min_samples")
+	}
+	return nil
+}
+
+func (c HedgeConfig) enabled() bool {
+	return c.Delay > 0 || c.Percentile > 0
+}
+
+// delay is how long to wait for u before hedging, false when there's no basis to hedge yet
+func (c HedgeConfig) delay(u *upstream) (time.Duration, bool) {
+	if c.Percentile > 0 {
+		if d, ok := u.latencies.percentile(c.Percentile, c.MinSamples); ok {
+			if d < c.MinDelay {
+				d = c.MinDelay
+			}
+			return d, true
+		}
+	}
+	return c.Delay, c.Delay > 0
+}
+
+// latencyWindowSize is how many of the latest latencies a host keeps for the percentiles
+const latencyWindowSize = 256
+
+// latencyWindow is a ring of the latest successful request latencies of a host
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (w *latencyWindow) observe(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.samples) < latencyWindowSize {
+		w.samples = append(w.samples, d)
+		return
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % latencyWindowSize
+}
+
+// percentile of the window, false until it holds minSamples
+func (w *latencyWindow) percentile(p float64, minSamples int) (time.Duration, bool) {
+	w.mu.Lock()
+	if len(w.samples) == 0 || len(w.samples) < minSamples {
+		w.mu.Unlock()
+		return 0, false
+	}
+	sorted := append([]time.Duration(nil), w.samples...)
+	w.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i], true
+}
+
+type attemptResult struct {
+	resp   *model.MachineTranslationResponse
+	err    error
+	hedged bool
+}
+
+// hedged sends req to up and, if it hasn't answered within the hedge delay, to a second endpoint
+// of the pool as well. The first success wins, the slower request is cancelled.
+func (m *MaestroProxyTranslator) hedged(
+	ctx context.Context, pool *endpointPool, up *upstream, req *model.MachineTranslationRequest,
+) (*model.MachineTranslationResponse, error) {
+	policy := m.hedge
+	if pool.hedge != nil {
+		policy = *pool.hedge
+	}
+	delay, ok := policy.delay(up)
+	if !policy.enabled() || !ok {
+		return m.attempt(ctx, pool, up, req)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// buffered so the loser doesn't block once nobody is listening
+	results := make(chan attemptResult, 2)
+	send := func(u *upstream, hedged bool) {
+		resp, err := m.attempt(ctx, pool, u, req)
+		results <- attemptResult{resp: resp, err: err, hedged: hedged}
+	}
+	go send(up, false)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		return r.resp, r.err
+	case <-ctx.Done():
+		r := <-results
+		return r.resp, r.err
+	case <-timer.C:
+	}
+
+	now := time.Now()
+	second := pool.pick(now, func(host string) bool {
+		return host != up.host && m.usable(host, now)
+	})
+	if second.host == up.host {
+		// pick falls back to any endpoint, hedging on the slow host itself won't help
+		r := <-results
+		return r.resp, r.err
+	}
+	hedgesCounter.WithLabelValues(up.host, hedgeSent).Inc()
+	go send(second, true)
+
+	first := <-results
+	if first.err != nil {
+		// the other one may still succeed
+		if other := <-results; other.err == nil {
+			first = other
+		}
+	}
+	if first.hedged && first.err == nil {
+		hedgesCounter.WithLabelValues(up.host, hedgeWon).Inc()
+	} else {
+		hedgesCounter.WithLabelValues(up.host, hedgeLost).Inc()
+	}
+	return first.resp, first.err
+}
@@ -0,0 +1,174 @@
+//go:build unit
+// +build unit
+
+package mtproxy
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/msf/cachingproxy/clients/maestro"
+	"github.com/msf/cachingproxy/model"
+	mmodel "github.com/msf/cachingproxy/model/maestro"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// slowMaestro answers the slow host only once the request is cancelled, or after a minute
+type slowMaestro struct {
+	maestro.Maestro
+	slow string
+
+	mu        sync.Mutex
+	calls     map[string]int
+	cancelled map[string]int
+}
+
+func (f *slowMaestro) MachineTranslate(
+	ctx context.Context, serviceURL string, req *mmodel.MTRequest) (*mmodel.MTResponse, error) {
+	f.mu.Lock()
+	f.calls[serviceURL]++
+	f.mu.Unlock()
+	if serviceURL == "http://"+f.slow {
+		select {
+		case <-ctx.Done():
+			f.mu.Lock()
+			f.cancelled[serviceURL]++
+			f.mu.Unlock()
+			return nil, ctx.Err()
+		case <-time.After(time.Minute):
+		}
+	}
+	return &mmodel.MTResponse{TranslatedData: mmodel.TranslatedData{
+		Nuggets: []mmodel.Nugget{{Position: 0, Text: req.Text, MTText: serviceURL}},
+	}}, nil
+}
+
+func hedgeRoute(hosts ...string) map[RoutingKey]Route {
+	r := Route{Balancer: BalancerRoundRobin}
+	for _, h := range hosts {
+		r.Endpoints = append(r.Endpoints, Endpoint{Host: h, Weight: 1})
+	}
+	return map[RoutingKey]Route{{}: r}
+}
+
+func TestHedgeWinsOverSlowEndpoint(t *testing.T) {
+	client := &slowMaestro{slow: "slow.hedge", calls: make(map[string]int), cancelled: make(map[string]int)}
+	p := newMaestroProxyTranslator(client, Config{
+		Routes: hedgeRoute("slow.hedge", "fast.hedge"),
+		Hedge:  HedgeConfig{Delay: 10 * time.Millisecond},
+	})
+	req := &model.MachineTranslationRequest{
+		Segments: []string{"Hello."},
+		Metadata: model.MTRequestMetadata{SourceLang: "en", TargetLang: "pt"},
+	}
+	// the counters are global, only their change is down to this test
+	slowSent := hedgesCounter.WithLabelValues("slow.hedge", hedgeSent)
+	slowWon := hedgesCounter.WithLabelValues("slow.hedge", hedgeWon)
+	fastSent := hedgesCounter.WithLabelValues("fast.hedge", hedgeSent)
+	slowSentBefore, slowWonBefore := testutil.ToFloat64(slowSent), testutil.ToFloat64(slowWon)
+	fastSentBefore := testutil.ToFloat64(fastSent)
+
+	// round robin starts on the slow host
+	resp, err := p.Handle(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, []model.TargetSegment{"http://fast.hedge"}, resp.TargetSegments)
+	assert.Equal(t, 1.0, testutil.ToFloat64(slowSent)-slowSentBefore)
+	assert.Equal(t, 1.0, testutil.ToFloat64(slowWon)-slowWonBefore)
+	assert.Eventually(t, func() bool {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		return client.cancelled["http://slow.hedge"] == 1
+	}, time.Second, time.Millisecond)
+	// losing a hedge isn't a failure of the slow host
+	assert.True(t, p.usable("slow.hedge", time.Now()))
+	assert.Equal(t, breakerClosed, p.breakers["slow.hedge"].state)
+
+	// the fast host answers before the delay, nothing to hedge
+	_, err = p.Handle(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, 0.0, testutil.ToFloat64(fastSent)-fastSentBefore)
+	client.mu.Lock()
+	assert.Equal(t, map[string]int{"http://slow.hedge": 1, "http://fast.hedge": 2}, client.calls)
+	client.mu.Unlock()
+}
+
+func TestHedgeDisabled(t *testing.T) {
+	client := &hostMaestro{calls: make(map[string]int)}
+	p := newMaestroProxyTranslator(client, Config{Routes: hedgeRoute("a.nohedge", "b.nohedge")})
+	_, err := p.Handle(context.Background(), &model.MachineTranslationRequest{
+		Segments: []string{"Hello."},
+		Metadata: model.MTRequestMetadata{SourceLang: "en", TargetLang: "pt"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"http://a.nohedge": 1}, client.calls)
+}
+
+func TestHedgeDelayFromObservedPercentile(t *testing.T) {
+	cfg := HedgeConfig{Percentile: 0.95, MinSamples: 10, MinDelay: 5 * time.Millisecond}
+	u := &upstream{host: "a.foo"}
+
+	_, ok := cfg.delay(u)
+	assert.False(t, ok, "no latencies, nothing to hedge on")
+
+	for i := 1; i <= 100; i++ {
+		u.latencies.observe(time.Duration(i) * time.Millisecond)
+	}
+	d, ok := cfg.delay(u)
+	assert.True(t, ok)
+	assert.Equal(t, 95*time.Millisecond, d)
+
+	// the window only keeps the latest latencies
+	for i := 0; i < latencyWindowSize; i++ {
+		u.latencies.observe(time.Millisecond)
+	}
+	d, _ = cfg.delay(u)
+	assert.Equal(t, cfg.MinDelay, d)
+
+	// with a fixed delay to fall back on
+	cfg.Delay = time.Second
+	d, ok = cfg.delay(&upstream{})
+	assert.True(t, ok)
+	assert.Equal(t, time.Second, d)
+}
+
+func TestHedgeSkipsTheSlowHostItself(t *testing.T) {
+	client := &slowMaestro{slow: "single.hedge", calls: make(map[string]int), cancelled: make(map[string]int)}
+	p := newMaestroProxyTranslator(client, Config{
+		Routes: hedgeRoute("single.hedge"),
+		Hedge:  HedgeConfig{Delay: 5 * time.Millisecond},
+	})
+	sent := hedgesCounter.WithLabelValues("single.hedge", hedgeSent)
+	sentBefore := testutil.ToFloat64(sent)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := p.Handle(ctx, &model.MachineTranslationRequest{
+		Segments: []string{"Hello."},
+		Metadata: model.MTRequestMetadata{SourceLang: "en", TargetLang: "pt"},
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 0.0, testutil.ToFloat64(sent)-sentBefore)
+	client.mu.Lock()
+	assert.Equal(t, map[string]int{"http://single.hedge": 1}, client.calls)
+	client.mu.Unlock()
+}
+
+func TestRouteHedgeOverride(t *testing.T) {
+	client := &slowMaestro{slow: "slow.route", calls: make(map[string]int), cancelled: make(map[string]int)}
+	routes := hedgeRoute("slow.route", "fast.route")
+	r := routes[RoutingKey{}]
+	// hedging is disabled by default, but not on this route
+	r.Hedge = &HedgeConfig{Delay: 5 * time.Millisecond}
+	routes[RoutingKey{}] = r
+	p := newMaestroProxyTranslator(client, Config{Routes: routes})
+
+	resp, err := p.Handle(context.Background(), &model.MachineTranslationRequest{
+		Segments: []string{"Hello."},
+		Metadata: model.MTRequestMetadata{SourceLang: "en", TargetLang: "pt"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []model.TargetSegment{"http://fast.route"}, resp.TargetSegments)
+}
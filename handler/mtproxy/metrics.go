@@ -0,0 +1,72 @@
+package mtproxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var negativeCacheCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "mtproxy",
+	Name:      "negative_cache_total",
+	Help:      "Upstream failures remembered by kind (route or segment), and event (stored, hit or dropped).",
+}, []string{"kind", "event"})
+
+var breakerStateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "mtproxy",
+	Name:      "circuit_breaker_state",
+	Help:      "Circuit breaker state by maestro host: 0 closed, 1 half open, 2 open.",
+}, []string{"host"})
+
+var breakerTransitionsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "mtproxy",
+	Name:      "circuit_breaker_transitions_total",
+	Help:      "Circuit breaker state changes by maestro host and new state.",
+}, []string{"host", "state"})
+
+var breakerRejectedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "mtproxy",
+	Name:      "circuit_breaker_rejected_total",
+	Help:      "Requests failed fast by an open circuit breaker, by maestro host.",
+}, []string{"host"})
+
+var endpointHealthyGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "mtproxy",
+	Name:      "endpoint_healthy",
+	Help:      "Active health check state by maestro host: 1 healthy, 0 unhealthy.",
+}, []string{"host"})
+
+var endpointOutstandingGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "mtproxy",
+	Name:      "endpoint_outstanding_requests",
+	Help:      "Requests in flight by maestro host.",
+}, []string{"host"})
+
+var endpointEjectionsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "mtproxy",
+	Name:      "endpoint_ejections_total",
+	Help:      "Maestro hosts ejected from their routes by the outlier detection.",
+}, []string{"host"})
+
+const (
+	hedgeSent = "sent"
+	hedgeWon  = "won"
+	hedgeLost = "lost"
+)
+
+var hedgesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "mtproxy",
+	Name:      "hedged_requests_total",
+	Help:      "Hedged requests by the slow maestro host, and outcome (sent, won when the hedge answered first, lost otherwise).",
+}, []string{"host", "outcome"})
+
+func init() {
+	prometheus.MustRegister(
+		negativeCacheCounter,
+		breakerStateGauge,
+		breakerTransitionsCounter,
+		breakerRejectedCounter,
+		endpointHealthyGauge,
+		endpointOutstandingGauge,
+		endpointEjectionsCounter,
+		hedgesCounter,
+	)
+}
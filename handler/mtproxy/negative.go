@@ -0,0 +1,123 @@
+package mtproxy
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/msf/cachingproxy/clients/maestro"
+)
+
+const (
+	negativeKindRoute   = "route"
+	negativeKindSegment = "segment"
+
+	// bounds the memory used by a failure storm, entries are dropped when full
+	maxNegativeEntries = 100_000
+)
+
+type negativeEntry struct {
+	err     error
+	expires time.Time
+}
+
+// negativeCache remembers recent upstream failures, so they are returned right away
+// instead of being retried on every request. A zero ttl disables it.
+type negativeCache struct {
+	kind string
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]negativeEntry
+}
+
+func newNegativeCache(kind string, ttl time.Duration) *negativeCache {
+	return &negativeCache{
+		kind:    kind,
+		ttl:     ttl,
+		entries: make(map[string]negativeEntry),
+	}
+}
+
+// get returns the cached failure of the first failing key
+func (n *negativeCache) get(keys []string, now time.Time) error {
+	if n.ttl <= 0 {
+		return nil
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, k := range keys {
+		e, found := n.entries[k]
+		if !found {
+			continue
+		}
+		if !e.expires.After(now) {
+			delete(n.entries, k)
+			continue
+		}
+		negativeCacheCounter.WithLabelValues(n.kind, "hit").Inc()
+		return e.err
+	}
+	return nil
+}
+
+// failing is true when get would return an error for key, without counting a hit
+func (n *negativeCache) failing(key string, now time.Time) bool {
+	if n.ttl <= 0 {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	e, found := n.entries[key]
+	return found && e.expires.After(now)
+}
+
+func (n *negativeCache) set(keys []string, err error, now time.Time) {
+	if n.ttl <= 0 {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.entries)+len(keys) > maxNegativeEntries {
+		n.removeExpired(now)
+	}
+	e := negativeEntry{err: err, expires: now.Add(n.ttl)}
+	for _, k := range keys {
+		if len(n.entries) >= maxNegativeEntries {
+			negativeCacheCounter.WithLabelValues(n.kind, "dropped").Inc()
+			return
+		}
+		n.entries[k] = e
+		negativeCacheCounter.WithLabelValues(n.kind, "stored").Inc()
+	}
+}
+
+func (n *negativeCache) removeExpired(now time.Time) {
+	for k, e := range n.entries {
+		if !e.expires.After(now) {
+			delete(n.entries, k)
+		}
+	}
+}
+
+// isSegmentFailure is true for the failures blaming the request payload: 4XX maestro
+// responses and responses that can't be mapped back to the segments, those are cached
+// per segment. Anything else (5XX after retries, timeouts, connection errors, 429) is
+// blamed on the route.
+func isSegmentFailure(err error) bool {
+	if errors.Is(err, errUnmatchedNugget) {
+		return true
+	}
+	var statusErr *maestro.StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	switch statusErr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusProxyAuthRequired,
+		http.StatusRequestTimeout, http.StatusTooManyRequests:
+		// about the request or maestro itself, whatever the segments
+		return false
+	}
+	return statusErr.StatusCode >= 400 && statusErr.StatusCode < 500
+}
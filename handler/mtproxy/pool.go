@@ -0,0 +1,189 @@
+package mtproxy
+
+import (
+	"sync"
+	"time"
+)
+
+// OutlierConfig ejects the endpoints failing consecutive requests from their routes,
+// until the ejection time passes
+type OutlierConfig struct {
+	// ConsecutiveErrors ejects an endpoint, zero disables outlier detection
+	ConsecutiveErrors int
+	// BaseEjectionTime is the first ejection time of an endpoint, it grows with every
+	// ejection in a row up to MaxEjectionTime
+	BaseEjectionTime time.Duration
+	MaxEjectionTime  time.Duration
+}
+
+// upstream is the load balancing state of a maestro host, shared by every route it serves
+type upstream struct {
+	host string
+
+	mu          sync.Mutex
+	outstanding int
+	// set by the active health checks
+	healthy                       bool
+	checkFailures, checkSuccesses int
+	// set by the outlier detection
+	consecutiveErrors int
+	ejections         int
+	ejectedUntil      time.Time
+
+	// successful request latencies, for the hedge delay
+	latencies latencyWindow
+}
+
+// available is true when neither the health checks nor the outlier detection
+// pulled the upstream out of rotation
+func (u *upstream) available(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.healthy && !now.Before(u.ejectedUntil)
+}
+
+// upstreams are the upstream of every configured host
+type upstreams struct {
+	outlier OutlierConfig
+	byHost  map[string]*upstream
+}
+
+func newUpstreams(hosts []string, outlier OutlierConfig) *upstreams {
+	ups := &upstreams{outlier: outlier, byHost: make(map[string]*upstream, len(hosts))}
+	for _, h := range hosts {
+		ups.byHost[h] = &upstream{host: h, healthy: true}
+		endpointHealthyGauge.WithLabelValues(h).Set(1)
+	}
+	return ups
+}
+
+// start counts a request to u as outstanding, done must be called once it finishes
+func (ups *upstreams) start(u *upstream) {
+	u.mu.Lock()
+	u.outstanding++
+	u.mu.Unlock()
+	endpointOutstandingGauge.WithLabelValues(u.host).Inc()
+}
+
+func (ups *upstreams) done(u *upstream, result breakerResult, now time.Time) {
+	endpointOutstandingGauge.WithLabelValues(u.host).Dec()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.outstanding--
+	switch result {
+	case breakerSuccess:
+		u.consecutiveErrors = 0
+		if !now.Before(u.ejectedUntil) {
+			u.ejections = 0
+		}
+	case breakerFailure:
+		u.consecutiveErrors++
+		if ups.outlier.ConsecutiveErrors > 0 && u.consecutiveErrors >= ups.outlier.ConsecutiveErrors &&
+			!now.Before(u.ejectedUntil) {
+			u.ejections++
+			u.consecutiveErrors = 0
+			u.ejectedUntil = now.Add(ups.ejectionTime(u.ejections))
+			endpointEjectionsCounter.WithLabelValues(u.host).Inc()
+		}
+	}
+}
+
+func (ups *upstreams) ejectionTime(ejections int) time.Duration {
+	d := time.Duration(ejections) * ups.outlier.BaseEjectionTime
+	if ups.outlier.MaxEjectionTime > 0 && d > ups.outlier.MaxEjectionTime {
+		return ups.outlier.MaxEjectionTime
+	}
+	return d
+}
+
+type poolEndpoint struct {
+	upstream *upstream
+	weight   int
+	// smooth weighted round robin counter
+	current int
+}
+
+// endpointPool balances the requests of a route among its endpoints
+type endpointPool struct {
+	balancer string
+	// hedge replaces the default hedge policy for the route, when set
+	hedge       *HedgeConfig
+	concurrency *routeLimiter
+
+	mu        sync.Mutex
+	endpoints []*poolEndpoint
+}
+
+// newEndpointPool balances r among ups, with up to maxConcurrency requests at once
+func newEndpointPool(r Route, ups *upstreams, maxConcurrency int) *endpointPool {
+	p := &endpointPool{balancer: r.Balancer, hedge: r.Hedge, concurrency: newRouteLimiter(maxConcurrency)}
+	for _, e := range r.Endpoints {
+		p.endpoints = append(p.endpoints, &poolEndpoint{upstream: ups.byHost[e.Host], weight: e.Weight})
+	}
+	return p
+}
+
+// pick chooses the endpoint for a request among the available and usable ones. When there
+// are none it falls back to the usable ones, and then to any, rather than failing here:
+// the caller fails fast on endpoints known to be failing.
+func (p *endpointPool) pick(now time.Time, usable func(host string) bool) *upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.endpoints) == 1 {
+		return p.endpoints[0].upstream
+	}
+
+	var candidates []*poolEndpoint
+	for _, e := range p.endpoints {
+		if e.upstream.available(now) && usable(e.upstream.host) {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, e := range p.endpoints {
+			if usable(e.upstream.host) {
+				candidates = append(candidates, e)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.endpoints
+	}
+
+	if p.balancer == BalancerLeastOutstanding {
+		return leastOutstanding(candidates).upstream
+	}
+	return smoothWeightedRoundRobin(candidates).upstream
+}
+
+// smoothWeightedRoundRobin is the nginx algorithm: it spreads each endpoint picks
+// evenly, instead of picking the same endpoint weight times in a row
+func smoothWeightedRoundRobin(candidates []*poolEndpoint) *poolEndpoint {
+	var best *poolEndpoint
+	total := 0
+	for _, e := range candidates {
+		e.current += e.weight
+		total += e.weight
+		if best == nil || e.current > best.current {
+			best = e
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// leastOutstanding picks the endpoint with the fewest outstanding requests per weight
+func leastOutstanding(candidates []*poolEndpoint) *poolEndpoint {
+	var best *poolEndpoint
+	bestOutstanding := 0
+	for _, e := range candidates {
+		e.upstream.mu.Lock()
+		outstanding := e.upstream.outstanding
+		e.upstream.mu.Unlock()
+		// outstanding/weight < bestOutstanding/best.weight
+		if best == nil || outstanding*best.weight < bestOutstanding*e.weight {
+			best, bestOutstanding = e, outstanding
+		}
+	}
+	return best
+}
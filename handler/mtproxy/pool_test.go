@@ -0,0 +1,167 @@
+//go:build unit
+// +build unit
+
+package mtproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/msf/cachingproxy/clients/maestro"
+	"github.com/msf/cachingproxy/model"
+	mmodel "github.com/msf/cachingproxy/model/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+func testPool(balancer string, outlier OutlierConfig, endpoints ...Endpoint) (*endpointPool, *upstreams) {
+	r := Route{Endpoints: endpoints, Balancer: balancer}
+	ups := newUpstreams(hostsOf(map[RoutingKey]Route{{}: r}), outlier)
+	return newEndpointPool(r, ups, 0), ups
+}
+
+func anyHost(string) bool { return true }
+
+func pickCounts(p *endpointPool, n int, usable func(string) bool) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[p.pick(time.Now(), usable).host]++
+	}
+	return counts
+}
+
+func TestPoolWeightedRoundRobin(t *testing.T) {
+	p, _ := testPool(BalancerRoundRobin, OutlierConfig{},
+		Endpoint{Host: "a.foo", Weight: 2}, Endpoint{Host: "b.foo", Weight: 1})
+	// smooth: the heavier endpoint isn't picked twice in a row
+	var seq []string
+	for i := 0; i < 3; i++ {
+		seq = append(seq, p.pick(time.Now(), anyHost).host)
+	}
+	assert.Equal(t, []string{"a.foo", "b.foo", "a.foo"}, seq)
+	assert.Equal(t, map[string]int{"a.foo": 200, "b.foo": 100}, pickCounts(p, 300, anyHost))
+}
+
+func TestPoolLeastOutstanding(t *testing.T) {
+	p, ups := testPool(BalancerLeastOutstanding, OutlierConfig{},
+		Endpoint{Host: "a.foo", Weight: 1}, Endpoint{Host: "b.foo", Weight: 1})
+	a := p.pick(time.Now(), anyHost)
+	ups.start(a)
+	b := p.pick(time.Now(), anyHost)
+	assert.NotEqual(t, a.host, b.host)
+	ups.start(b)
+	ups.start(b)
+	assert.Equal(t, a.host, p.pick(time.Now(), anyHost).host)
+}
+
+func TestPoolSkipsUnavailable(t *testing.T) {
+	p, ups := testPool(BalancerRoundRobin, OutlierConfig{ConsecutiveErrors: 2, BaseEjectionTime: time.Minute},
+		Endpoint{Host: "a.foo", Weight: 1}, Endpoint{Host: "b.foo", Weight: 1})
+	now := time.Now()
+	a := ups.byHost["a.foo"]
+	for i := 0; i < 2; i++ {
+		ups.start(a)
+		ups.done(a, breakerFailure, now)
+	}
+	assert.Equal(t, map[string]int{"b.foo": 10}, pickCounts(p, 10, anyHost))
+
+	// not usable, e.g. its breaker is open
+	onlyA := func(h string) bool { return h == "a.foo" }
+	assert.Equal(t, map[string]int{"a.foo": 10}, pickCounts(p, 10, onlyA))
+	// nothing is usable, every endpoint is still a candidate
+	assert.Equal(t, map[string]int{"a.foo": 5, "b.foo": 5}, pickCounts(p, 10, func(string) bool { return false }))
+
+	// health checks pull endpoints out too
+	ups.byHost["b.foo"].checked(HealthCheckConfig{UnhealthyThreshold: 1}, errors.New("down"))
+	assert.Equal(t, map[string]int{"a.foo": 10}, pickCounts(p, 10, onlyA))
+}
+
+func TestOutlierEjectionTimeGrows(t *testing.T) {
+	_, ups := testPool(BalancerRoundRobin, OutlierConfig{
+		ConsecutiveErrors: 1, BaseEjectionTime: time.Minute, MaxEjectionTime: 3 * time.Minute,
+	}, Endpoint{Host: "a.foo", Weight: 1})
+	a := ups.byHost["a.foo"]
+	now := time.Now()
+	for _, expected := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		ups.start(a)
+		ups.done(a, breakerFailure, now)
+		assert.Equal(t, now.Add(expected), a.ejectedUntil)
+		assert.False(t, a.available(now))
+		now = a.ejectedUntil
+	}
+	// a success once back resets the ejections
+	ups.start(a)
+	ups.done(a, breakerSuccess, now)
+	assert.Equal(t, 0, a.ejections)
+	assert.True(t, a.available(now))
+}
+
+func TestHealthChecks(t *testing.T) {
+	healthy := make(chan bool, 1)
+	healthy <- false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/health", r.URL.Path)
+		ok := <-healthy
+		healthy <- ok
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	ups := newUpstreams([]string{srv.URL}, OutlierConfig{})
+	stop := ups.startHealthChecks(HealthCheckConfig{Path: "/health", Interval: 5 * time.Millisecond})
+	defer stop()
+	u := ups.byHost[srv.URL]
+	assert.Eventually(t, func() bool { return !u.available(time.Now()) }, time.Second, 5*time.Millisecond)
+
+	<-healthy
+	healthy <- true
+	assert.Eventually(t, func() bool { return u.available(time.Now()) }, time.Second, 5*time.Millisecond)
+}
+
+// hostMaestro fails the requests to the failing host
+type hostMaestro struct {
+	maestro.Maestro
+	failing string
+	calls   map[string]int
+}
+
+func (f *hostMaestro) MachineTranslate(
+	ctx context.Context, serviceURL string, req *mmodel.MTRequest) (*mmodel.MTResponse, error) {
+	f.calls[serviceURL]++
+	if serviceURL == "http://"+f.failing {
+		return nil, errors.New("giving up after 3 attempt(s)")
+	}
+	return &mmodel.MTResponse{TranslatedData: mmodel.TranslatedData{
+		Nuggets: []mmodel.Nugget{{Position: 0, Text: req.Text, MTText: "ok"}},
+	}}, nil
+}
+
+func TestHandleRoutesAroundFailingEndpoint(t *testing.T) {
+	client := &hostMaestro{failing: "a.foo", calls: make(map[string]int)}
+	p := newMaestroProxyTranslator(client, Config{
+		Routes: map[RoutingKey]Route{{}: {
+			Endpoints: []Endpoint{{Host: "a.foo", Weight: 1}, {Host: "b.foo", Weight: 1}},
+			Balancer:  BalancerRoundRobin,
+		}},
+		Outlier: OutlierConfig{ConsecutiveErrors: 1, BaseEjectionTime: time.Minute},
+	})
+	defer p.Close()
+
+	failures := 0
+	for i := 0; i < 10; i++ {
+		_, err := p.Handle(context.Background(), &model.MachineTranslationRequest{
+			Segments: []string{"Hello."},
+			Metadata: model.MTRequestMetadata{SourceLang: "en", TargetLang: "pt"},
+		})
+		if err != nil {
+			failures++
+		}
+	}
+	assert.Equal(t, 1, failures)
+	assert.Equal(t, map[string]int{"http://a.foo": 1, "http://b.foo": 9}, client.calls)
+}
@@ -1,58 +1,394 @@
 package mtproxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
 
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/msf/cachingproxy/clients/maestro"
 	"github.com/msf/cachingproxy/handler"
+	"github.com/msf/cachingproxy/handler/mtcache"
 	"github.com/msf/cachingproxy/model"
+	mmodel "github.com/msf/cachingproxy/model/maestro"
 )
 
-type RoutingKey struct { // TODO use more fields
-	SourceLang string
-	TargetLang string
+// RoutingKey selects the engine for a request, empty fields are wildcards and match any value.
+// ContentType, ClientBrand, Tone and Origin are taken from the request MTRequestMetadata.Metadata
+type RoutingKey struct {
+	SourceLang  string
+	TargetLang  string
+	ContentType string
+	ClientBrand string
+	Tone        string
+	Origin      string
+}
+
+type Config struct {
+	// used to identify to which hostname/path a request should go
+	Routes map[RoutingKey]Route
+
+	// the default maestro credentials, for the routes without Auth
+	MaestroUsername       string
+	MaestroPassword       maestro.Secret
+	CharsPerSecondTimeout float64
+
+	// how long upstream failures are remembered and returned without calling maestro,
+	// per route for 5XX/timeouts and per segment for 4XX. Zero disables them.
+	NegativeRouteTTL   time.Duration
+	NegativeSegmentTTL time.Duration
+
+	// MaxBatchSegments and MaxBatchChars bound the segments sent to maestro in one request,
+	// bigger requests are split into batches. Zero is unlimited.
+	MaxBatchSegments int
+	MaxBatchChars    int
+	// MaxRouteConcurrency bounds the concurrent maestro requests of each route, whatever
+	// endpoint they go to, the others wait their turn. Zero is unlimited.
+	MaxRouteConcurrency int
+
+	Breaker     BreakerConfig
+	Outlier     OutlierConfig
+	HealthCheck HealthCheckConfig
+	Hedge       HedgeConfig
+	// Retry is the default retry policy of the routes, maestro.DefaultRetryPolicy when unset
+	Retry maestro.RetryPolicy
+	// Timeouts learns the timeouts of each maestro endpoint, CharsPerSecondTimeout is used
+	// until there are enough samples, or when disabled
+	Timeouts maestro.AdaptiveTimeouts
 }
 
 // MaestroProxyTranslator translates by calling maestro endpoints
 type MaestroProxyTranslator struct {
-	client http.Client // TODO http retry logic
+	client maestro.Maestro
+	// clients of the hosts with their own credentials
+	clients map[string]maestro.Maestro
 
 	// used to identify to which hostname/path a request should go
-	routingMap map[RoutingKey]string
+	routes *router
+
+	failedRoutes   *negativeCache
+	failedSegments *negativeCache
+
+	upstreams        *upstreams
+	stopHealthChecks func()
+	breakers         map[string]*circuitBreaker
+	hedge            HedgeConfig
 }
 
-func NewMaestroProxyTranslator(routingMap map[RoutingKey]string) (handler.MachineTranslationHandler, error) {
-	if len(routingMap) < 1 {
+func NewMaestroProxyTranslator(config Config) (handler.MachineTranslationHandler, error) {
+	if len(config.Routes) < 1 {
 		return nil, fmt.Errorf("MaestroProxyTranslator needs a routingMap, got zero entries")
 	}
-	return &MaestroProxyTranslator{
-		client:     *http.DefaultClient,
-		routingMap: routingMap,
-	}, nil
+	if config.CharsPerSecondTimeout <= 0 {
+		config.CharsPerSecondTimeout = maestro.DefaultCharsPersSecondTimeout
+	}
+	logger := kitlog.NewLogfmtLogger(kitlog.NewSyncWriter(os.Stderr))
+
+	if config.Retry == (maestro.RetryPolicy{}) {
+		config.Retry = maestro.DefaultRetryPolicy
+	}
+	// nil unless some route goes with the default credentials and retry policy
+	var client maestro.Maestro
+	clients := make(map[string]maestro.Maestro)
+	// clients are picked by host, the routes may not have been checked by NewRoutingMap
+	hostRoutes := make(map[string]Route)
+	for k, r := range config.Routes {
+		for _, e := range r.Endpoints {
+			if prev, found := hostRoutes[e.Host]; found && !sameClient(prev, r) {
+				return nil, fmt.Errorf("route %+v: host %q already used with other auth, retry or hedge", k, e.Host)
+			}
+			hostRoutes[e.Host] = r
+		}
+	}
+	for k, r := range config.Routes {
+		if r.Auth == nil && r.Retry == nil && client != nil {
+			continue
+		}
+		c, err := newRouteClient(logger, config, r)
+		if err != nil {
+			return nil, fmt.Errorf("route %+v: %w", k, err)
+		}
+		if r.Auth == nil && r.Retry == nil {
+			client = c
+			continue
+		}
+		for _, e := range r.Endpoints {
+			clients[e.Host] = c
+		}
+	}
+	m := newMaestroProxyTranslator(client, config)
+	m.clients = clients
+	return m, nil
+}
+
+// newRouteClient is a maestro client with the route credentials and retry policy,
+// or the config ones when the route doesn't set them
+func newRouteClient(logger kitlog.Logger, config Config, r Route) (maestro.Maestro, error) {
+	var auth maestro.Auth = maestro.BasicAuth{Username: config.MaestroUsername, Password: config.MaestroPassword}
+	if r.Auth != nil {
+		var err error
+		if auth, err = r.Auth.auth(); err != nil {
+			return nil, err
+		}
+	} else if config.MaestroUsername == "" || config.MaestroPassword == "" {
+		return nil, fmt.Errorf("MaestroProxyTranslator needs maestro credentials")
+	}
+	c := maestro.NewWithAuth(logger, auth, config.CharsPerSecondTimeout)
+	if c == nil {
+		return nil, fmt.Errorf("invalid maestro client arguments")
+	}
+	policy := config.Retry
+	if r.Retry != nil {
+		policy = r.Retry.policy(config.Retry)
+	}
+	c.SetRetryPolicy(policy)
+	c.SetAdaptiveTimeouts(config.Timeouts)
+	return c, nil
+}
+
+func newMaestroProxyTranslator(client maestro.Maestro, config Config) *MaestroProxyTranslator {
+	hosts := hostsOf(config.Routes)
+	ups := newUpstreams(hosts, config.Outlier)
+	m := &MaestroProxyTranslator{
+		client:           client,
+		routes:           newRouter(config.Routes, ups, config.MaxRouteConcurrency),
+		failedRoutes:     newNegativeCache(negativeKindRoute, config.NegativeRouteTTL),
+		failedSegments:   newNegativeCache(negativeKindSegment, config.NegativeSegmentTTL),
+		upstreams:        ups,
+		stopHealthChecks: func() {},
+		breakers:         newBreakers(hosts, config.Breaker),
+		hedge:            config.Hedge,
+	}
+	if config.HealthCheck.enabled() {
+		m.stopHealthChecks = ups.startHealthChecks(config.HealthCheck)
+	}
+	return m
+}
+
+// Close stops the health checks
+func (m *MaestroProxyTranslator) Close() error {
+	m.stopHealthChecks()
+	return nil
 }
 
 func (m *MaestroProxyTranslator) Handle(
-	req *model.MachineTranslationRequest) (resp *model.MachineTranslationResponse, err error) {
+	ctx context.Context, req *model.MachineTranslationRequest) (resp *model.MachineTranslationResponse, err error) {
 	k := keyForReq(req)
-	hostname, found := m.routingMap[k]
+	pool, found := m.routes.route(k)
 	if !found {
-		err = fmt.Errorf("no hostname for %+v for MaestroProxyTranslator", k)
+		// nothing upstream to protect, no need for negative caching
+		err = &handler.NoRouteError{Route: fmt.Sprintf("%+v", k)}
 		return
 	}
-	resp, err = m.doRequest(hostname, req)
+
+	now := time.Now()
+	up := pool.pick(now, func(host string) bool { return m.usable(host, now) })
+	if err = m.failedRoutes.get([]string{up.host}, now); err != nil {
+		return nil, fmt.Errorf("maestro %v recently failed: %w", up.host, err)
+	}
+	if err = m.failedSegments.get(negativeSegmentKeys(up.host, req), now); err != nil {
+		return nil, fmt.Errorf("maestro %v recently failed this segment: %w", up.host, err)
+	}
+	return m.hedged(ctx, pool, up, req)
+}
+
+// usable is false for the hosts known to be failing
+func (m *MaestroProxyTranslator) usable(host string, now time.Time) bool {
+	return !m.failedRoutes.failing(host, now) && !m.breakers[host].rejects(now)
+}
+
+// attempt sends req to up, an endpoint of pool, accounting the outcome in its breaker,
+// load balancing state and negative caches
+func (m *MaestroProxyTranslator) attempt(
+	ctx context.Context, pool *endpointPool, up *upstream, req *model.MachineTranslationRequest,
+) (resp *model.MachineTranslationResponse, err error) {
+	hostname := up.host
+	breaker := m.breakers[hostname]
+	if err = breaker.allow(time.Now()); err != nil {
+		return nil, &handler.UpstreamError{Host: hostname, Err: err}
+	}
+	m.upstreams.start(up)
+	result := breakerIgnored
+	defer func() {
+		breaker.done(result, time.Now())
+		m.upstreams.done(up, result, time.Now())
+	}()
+
+	if err = pool.concurrency.acquire(ctx); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	resp, err = m.doRequest(ctx, hostname, req)
+	pool.concurrency.release()
+
+	switch {
+	case err == nil:
+		result = breakerSuccess
+		up.latencies.observe(time.Since(start))
+	case ctx.Err() != nil:
+		// given up by the caller, or lost a hedge, says nothing about maestro
+	case isSegmentFailure(err):
+		// maestro is fine, the request isn't. Only a lone segment is known to be the culprit,
+		// the batches failing this way are bisected by the caller until it's found.
+		result = breakerSuccess
+		if len(req.Segments) == 1 {
+			m.failedSegments.set(negativeSegmentKeys(hostname, req), err, time.Now())
+		}
+	default:
+		result = breakerFailure
+		m.failedRoutes.set([]string{hostname}, err, time.Now())
+	}
 	return
 }
 
+func negativeSegmentKeys(hostname string, req *model.MachineTranslationRequest) []string {
+	keys := mtcache.KeysFor(req.Metadata, req.Segments)
+	for i, k := range keys {
+		keys[i] = hostname + "|" + k
+	}
+	return keys
+}
+
 func keyForReq(req *model.MachineTranslationRequest) RoutingKey {
+	md := req.Metadata.Metadata
 	return RoutingKey{
-		SourceLang: req.Metadata.SourceLang,
-		TargetLang: req.Metadata.TargetLang,
+		SourceLang:  req.Metadata.SourceLang,
+		TargetLang:  req.Metadata.TargetLang,
+		ContentType: md[model.MetadataContentType],
+		ClientBrand: md[model.MetadataClientBrand],
+		Tone:        md[model.MetadataTone],
+		Origin:      md[model.MetadataOrigin],
 	}
 }
 
-func (m *MaestroProxyTranslator) doRequest( //TODO: invoke maestro
-	hostname string, req *model.MachineTranslationRequest,
-) (resq *model.MachineTranslationResponse, err error) {
-	err = fmt.Errorf("doRequest not implemented")
-	return
+func (m *MaestroProxyTranslator) clientFor(hostname string) maestro.Maestro {
+	if c, found := m.clients[hostname]; found {
+		return c
+	}
+	return m.client
+}
+
+func (m *MaestroProxyTranslator) doRequest(
+	ctx context.Context, hostname string, req *model.MachineTranslationRequest,
+) (resp *model.MachineTranslationResponse, err error) {
+	mResp, err := m.clientFor(hostname).MachineTranslate(ctx, serviceURL(hostname), mtRequestFor(req))
+	if err != nil {
+		upstreamErr := &handler.UpstreamError{Host: hostname, Segment: isSegmentFailure(err), Err: err}
+		var statusErr *maestro.StatusError
+		if errors.As(err, &statusErr) {
+			upstreamErr.StatusCode = statusErr.StatusCode
+		}
+		return nil, upstreamErr
+	}
+
+	targets, err := segmentsFromNuggets(req.Segments, mResp.TranslatedData.Nuggets)
+	if err != nil {
+		return nil, &handler.UpstreamError{Host: hostname, Segment: true, Err: err}
+	}
+	return &model.MachineTranslationResponse{
+		RequestID:       req.ID,
+		TargetSegments:  targets,
+		RequestMetadata: req.Metadata,
+	}, nil
+}
+
+// serviceURL accepts routes given either as bare hostnames or full urls
+func serviceURL(hostname string) string {
+	if strings.Contains(hostname, "://") {
+		return strings.TrimSuffix(hostname, "/")
+	}
+	return "http://" + hostname
+}
+
+// mtRequestFor sends all segments as a single text, one segment per line. The line breaks of
+// a segment make it span several lines, segmentsFromNuggets puts them back together.
+func mtRequestFor(req *model.MachineTranslationRequest) *mmodel.MTRequest {
+	md := req.Metadata.Metadata
+	return &mmodel.MTRequest{
+		UID:            req.ID,
+		SourceLanguage: req.Metadata.SourceLang,
+		TargetLanguage: req.Metadata.TargetLang,
+		Text:           strings.Join(req.Segments, "\n"),
+		TextFormat:     "text",
+		ContentType:    md[model.MetadataContentType],
+		Origin:         md[model.MetadataOrigin],
+		ClientBrand:    md[model.MetadataClientBrand],
+		ClientUsername: md[model.MetadataClientUsername],
+		Tone:           md[model.MetadataTone],
+		GlossaryID:     md[model.MetadataGlossaryID],
+	}
+}
+
+var errUnmatchedNugget = errors.New("nugget does not match any segment")
+
+// segmentsFromNuggets maps the translated nuggets back onto the lines of the segments they came
+// from, comparing them regardless of how maestro spaced them. maestro may split a line into
+// several nuggets (one per sentence), those are joined back with a space. Only whitespace lines
+// may come back without any nugget, those are kept as is, any other line left without one means
+// a nugget was dropped.
+func segmentsFromNuggets(segments []string, nuggets []mmodel.Nugget) ([]model.TargetSegment, error) {
+	sorted := make([]mmodel.Nugget, len(nuggets))
+	copy(sorted, nuggets)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Position < sorted[j].Position
+	})
+
+	// every line of the text sent, owners[i] is the segment of lines[i]
+	var lines, spaced []string
+	var owners []int
+	for i, s := range segments {
+		for _, l := range strings.Split(s, "\n") {
+			lines = append(lines, l)
+			spaced = append(spaced, collapseSpaces(l))
+			owners = append(owners, i)
+		}
+	}
+
+	translated := make([][]string, len(lines))
+	line, offset := 0, 0
+	for _, n := range sorted {
+		source := n.Text
+		if source == "" {
+			source = n.TextNoRespace
+		}
+		source = collapseSpaces(source)
+		for ; line < len(lines); line, offset = line+1, 0 {
+			idx := strings.Index(spaced[line][offset:], source)
+			if idx >= 0 {
+				offset += idx + len(source)
+				break
+			}
+		}
+		if line >= len(lines) {
+			return nil, fmt.Errorf("%w: position %v", errUnmatchedNugget, n.Position)
+		}
+		translated[line] = append(translated[line], n.MTText)
+	}
+
+	targetLines := make([][]string, len(segments))
+	for i, parts := range translated {
+		seg := owners[i]
+		if len(parts) == 0 {
+			if strings.TrimSpace(lines[i]) != "" {
+				return nil, fmt.Errorf("%w: segment %v", errUnmatchedNugget, seg)
+			}
+			targetLines[seg] = append(targetLines[seg], lines[i])
+			continue
+		}
+		targetLines[seg] = append(targetLines[seg], strings.Join(parts, " "))
+	}
+	targets := make([]model.TargetSegment, len(segments))
+	for i, l := range targetLines {
+		targets[i] = model.TargetSegment(strings.Join(l, "\n"))
+	}
+	return targets, nil
+}
+
+// collapseSpaces trims s and turns every run of whitespace in it into a single space
+func collapseSpaces(s string) string {
+	return strings.Join(strings.Fields(s), " ")
 }
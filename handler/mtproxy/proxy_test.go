@@ -0,0 +1,226 @@
+//go:build unit
+// +build unit
+
+package mtproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/msf/cachingproxy/clients/maestro"
+	"github.com/msf/cachingproxy/handler"
+	"github.com/msf/cachingproxy/model"
+	mmodel "github.com/msf/cachingproxy/model/maestro"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeMaestro answers MachineTranslate, the other flows are unused by the proxy
+type fakeMaestro struct {
+	maestro.Maestro
+	serviceURL string
+	req        *mmodel.MTRequest
+	resp       *mmodel.MTResponse
+	err        error
+	calls      int
+}
+
+func (f *fakeMaestro) MachineTranslate(
+	ctx context.Context, serviceURL string, req *mmodel.MTRequest) (*mmodel.MTResponse, error) {
+	f.serviceURL = serviceURL
+	f.req = req
+	f.calls++
+	return f.resp, f.err
+}
+
+func hostRoute(host string) Route {
+	return Route{Endpoints: []Endpoint{{Host: host, Weight: 1}}, Balancer: BalancerRoundRobin}
+}
+
+func TestHandleMapsNuggetsToSegments(t *testing.T) {
+	client := &fakeMaestro{
+		resp: &mmodel.MTResponse{
+			TranslatedData: mmodel.TranslatedData{
+				Nuggets: []mmodel.Nugget{
+					{Position: 3, Text: "Bye.", MTText: "Adeus."},
+					{Position: 0, Text: "Hello there.", MTText: "Olá."},
+					{Position: 1, Text: "How are you?", MTText: "Como estás?"},
+					{Position: 2, Text: "123", MTText: "123"},
+				},
+			},
+		},
+	}
+	p := newMaestroProxyTranslator(client, Config{Routes: map[RoutingKey]Route{
+		{SourceLang: "en", TargetLang: "pt"}: hostRoute("bananas.foo"),
+	}})
+
+	resp, err := p.Handle(context.Background(), &model.MachineTranslationRequest{
+		ID:       "42",
+		Segments: []string{"Hello there. How are you?", "123", " ", "Bye."},
+		Metadata: model.MTRequestMetadata{
+			SourceLang: "en",
+			TargetLang: "pt",
+			Metadata:   map[string]string{model.MetadataContentType: "chat"},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "http://bananas.foo", client.serviceURL)
+	assert.Equal(t, "Hello there. How are you?\n123\n \nBye.", client.req.Text)
+	assert.Equal(t, "chat", client.req.ContentType)
+	assert.Equal(t, "42", resp.RequestID)
+	assert.Equal(t, []model.TargetSegment{"Olá. Como estás?", "123", " ", "Adeus."}, resp.TargetSegments)
+}
+
+func TestHandleWithoutRoute(t *testing.T) {
+	p := newMaestroProxyTranslator(&fakeMaestro{}, Config{Routes: map[RoutingKey]Route{
+		{SourceLang: "en", TargetLang: "pt"}: hostRoute("bananas.foo"),
+	}})
+	_, err := p.Handle(context.Background(), &model.MachineTranslationRequest{
+		Segments: []string{"hi"},
+		Metadata: model.MTRequestMetadata{SourceLang: "en", TargetLang: "de"},
+	})
+	assert.NotNil(t, err)
+}
+
+func TestSegmentsFromUnknownNugget(t *testing.T) {
+	_, err := segmentsFromNuggets(
+		[]string{"one", "two"},
+		[]mmodel.Nugget{{Position: 0, Text: "three", MTText: "três"}},
+	)
+	assert.NotNil(t, err)
+}
+
+func TestSegmentsFromDroppedNugget(t *testing.T) {
+	_, err := segmentsFromNuggets(
+		[]string{"one", "two", "three"},
+		[]mmodel.Nugget{{Position: 0, Text: "one", MTText: "um"}, {Position: 2, Text: "three", MTText: "três"}},
+	)
+	assert.ErrorIs(t, err, errUnmatchedNugget)
+}
+
+func TestSegmentsFromNuggetsWithLineBreaks(t *testing.T) {
+	targets, err := segmentsFromNuggets(
+		[]string{"Hello.\n\nBye.", "Ok."},
+		[]mmodel.Nugget{
+			{Position: 0, Text: "Hello.", MTText: "Olá."},
+			{Position: 1, Text: "Bye.", MTText: "Adeus."},
+			{Position: 2, Text: "Ok.", MTText: "Está bem."},
+		},
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, []model.TargetSegment{"Olá.\n\nAdeus.", "Está bem."}, targets)
+}
+
+func TestSegmentsFromRespacedNuggets(t *testing.T) {
+	targets, err := segmentsFromNuggets(
+		[]string{"  Hello   there.\tHow are you? ", "Bye."},
+		[]mmodel.Nugget{
+			{Position: 0, Text: "Hello there.", MTText: "Olá."},
+			{Position: 1, TextNoRespace: "How are you?", MTText: "Como estás?"},
+			{Position: 2, Text: " Bye. ", MTText: "Adeus."},
+		},
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, []model.TargetSegment{"Olá. Como estás?", "Adeus."}, targets)
+}
+
+func TestHandleNegativeCachesRouteFailures(t *testing.T) {
+	client := &fakeMaestro{err: errors.New("giving up after 3 attempt(s)")}
+	p := newMaestroProxyTranslator(client, Config{
+		Routes:           map[RoutingKey]Route{{SourceLang: "en", TargetLang: "pt"}: hostRoute("bananas.foo")},
+		NegativeRouteTTL: time.Minute,
+	})
+	md := model.MTRequestMetadata{SourceLang: "en", TargetLang: "pt"}
+
+	_, err := p.Handle(context.Background(), &model.MachineTranslationRequest{Segments: []string{"Hello."}, Metadata: md})
+	assert.ErrorIs(t, err, client.err)
+	// any segment on the same route fails without calling maestro
+	_, err = p.Handle(context.Background(), &model.MachineTranslationRequest{Segments: []string{"Bye."}, Metadata: md})
+	assert.ErrorIs(t, err, client.err)
+	assert.Equal(t, 1, client.calls)
+}
+
+func TestHandleNegativeCachesRejectedSegments(t *testing.T) {
+	client := &fakeMaestro{err: &maestro.StatusError{StatusCode: http.StatusUnprocessableEntity}}
+	p := newMaestroProxyTranslator(client, Config{
+		Routes:             map[RoutingKey]Route{{SourceLang: "en", TargetLang: "pt"}: hostRoute("bananas.foo")},
+		NegativeRouteTTL:   time.Minute,
+		NegativeSegmentTTL: time.Minute,
+	})
+	md := model.MTRequestMetadata{SourceLang: "en", TargetLang: "pt"}
+
+	_, err := p.Handle(context.Background(), &model.MachineTranslationRequest{Segments: []string{"Hello."}, Metadata: md})
+	assert.ErrorIs(t, err, client.err)
+	_, err = p.Handle(context.Background(), &model.MachineTranslationRequest{Segments: []string{"Hello."}, Metadata: md})
+	assert.ErrorIs(t, err, client.err)
+	assert.Equal(t, 1, client.calls)
+
+	// the route is still healthy for other segments
+	client.err = nil
+	client.resp = &mmodel.MTResponse{TranslatedData: mmodel.TranslatedData{
+		Nuggets: []mmodel.Nugget{{Position: 0, Text: "Bye.", MTText: "Adeus."}},
+	}}
+	resp, err := p.Handle(context.Background(), &model.MachineTranslationRequest{Segments: []string{"Bye."}, Metadata: md})
+	assert.Nil(t, err)
+	assert.Equal(t, []model.TargetSegment{"Adeus."}, resp.TargetSegments)
+	assert.Equal(t, 2, client.calls)
+}
+
+func TestHandleOnlyNegativeCachesLoneSegments(t *testing.T) {
+	client := &fakeMaestro{err: &maestro.StatusError{StatusCode: http.StatusUnprocessableEntity}}
+	p := newMaestroProxyTranslator(client, Config{
+		Routes:             map[RoutingKey]Route{{SourceLang: "en", TargetLang: "pt"}: hostRoute("bananas.foo")},
+		NegativeSegmentTTL: time.Minute,
+	})
+	md := model.MTRequestMetadata{SourceLang: "en", TargetLang: "pt"}
+
+	// which segment of the batch is to blame is unknown
+	_, err := p.Handle(context.Background(), &model.MachineTranslationRequest{Segments: []string{"Hello.", "Bye."}, Metadata: md})
+	assert.True(t, handler.IsSegmentFailure(err))
+	client.err = nil
+	client.resp = &mmodel.MTResponse{TranslatedData: mmodel.TranslatedData{
+		Nuggets: []mmodel.Nugget{{Position: 0, Text: "Bye.", MTText: "Adeus."}},
+	}}
+	_, err = p.Handle(context.Background(), &model.MachineTranslationRequest{Segments: []string{"Bye."}, Metadata: md})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, client.calls)
+}
+
+func TestHandleUnauthorizedIsNotASegmentFailure(t *testing.T) {
+	client := &fakeMaestro{err: &maestro.StatusError{StatusCode: http.StatusUnauthorized}}
+	p := newMaestroProxyTranslator(client, Config{
+		Routes: map[RoutingKey]Route{{SourceLang: "en", TargetLang: "pt"}: hostRoute("bananas.foo")},
+	})
+	_, err := p.Handle(context.Background(), &model.MachineTranslationRequest{
+		Segments: []string{"Hello.", "Bye."},
+		Metadata: model.MTRequestMetadata{SourceLang: "en", TargetLang: "pt"},
+	})
+	assert.NotNil(t, err)
+	assert.False(t, handler.IsSegmentFailure(err))
+}
+
+func TestHandleCancelledIsNotNegativelyCached(t *testing.T) {
+	client := &fakeMaestro{err: context.Canceled}
+	p := newMaestroProxyTranslator(client, Config{
+		Routes:           map[RoutingKey]Route{{SourceLang: "en", TargetLang: "pt"}: hostRoute("bananas.foo")},
+		NegativeRouteTTL: time.Minute,
+	})
+	req := &model.MachineTranslationRequest{
+		Segments: []string{"Hello."},
+		Metadata: model.MTRequestMetadata{SourceLang: "en", TargetLang: "pt"},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := p.Handle(ctx, req)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	client.err = nil
+	client.resp = &mmodel.MTResponse{TranslatedData: mmodel.TranslatedData{
+		Nuggets: []mmodel.Nugget{{Position: 0, Text: "Hello.", MTText: "Olá."}},
+	}}
+	_, err = p.Handle(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, client.calls)
+}
@@ -0,0 +1,49 @@
+package mtproxy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/msf/cachingproxy/clients/maestro"
+)
+
+// RetryConfig is the retry policy of a route, the fields left unset take the default policy ones
+type RetryConfig struct {
+	// MaxAttempts counts the first request too, 1 disables retries
+	MaxAttempts int           `mapstructure:"max_attempts" json:"max_attempts,omitempty"`
+	BaseBackoff time.Duration `mapstructure:"base_backoff" json:"base_backoff,omitempty"`
+	MaxBackoff  time.Duration `mapstructure:"max_backoff" json:"max_backoff,omitempty"`
+	// BudgetRatio caps the retries to that ratio of the route requests
+	BudgetRatio float64 `mapstructure:"budget_ratio" json:"budget_ratio,omitempty"`
+}
+
+func (c RetryConfig) validate() error {
+	switch {
+	case c.MaxAttempts < 0:
+		return fmt.Errorf("retry: negative max_attempts")
+	case c.BaseBackoff < 0 || c.MaxBackoff < 0:
+		return fmt.Errorf("retry: negative backoff")
+	case c.BaseBackoff > 0 && c.MaxBackoff > 0 && c.BaseBackoff > c.MaxBackoff:
+		return fmt.Errorf("retry: base_backoff over max_backoff")
+	case c.BudgetRatio < 0:
+		return fmt.Errorf("retry: negative budget_ratio")
+	}
+	return nil
+}
+
+func (c RetryConfig) policy(defaults maestro.RetryPolicy) maestro.RetryPolicy {
+	p := defaults
+	if c.MaxAttempts > 0 {
+		p.MaxAttempts = c.MaxAttempts
+	}
+	if c.BaseBackoff > 0 {
+		p.BaseBackoff = c.BaseBackoff
+	}
+	if c.MaxBackoff > 0 {
+		p.MaxBackoff = c.MaxBackoff
+	}
+	if c.BudgetRatio > 0 {
+		p.BudgetRatio = c.BudgetRatio
+	}
+	return p
+}
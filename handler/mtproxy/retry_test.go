@@ -0,0 +1,60 @@
+//go:build unit
+// +build unit
+
+package mtproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/msf/cachingproxy/clients/maestro"
+	"github.com/msf/cachingproxy/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryConfigOverridesDefaults(t *testing.T) {
+	defaults := maestro.RetryPolicy{MaxAttempts: 4, BaseBackoff: time.Millisecond, MaxBackoff: time.Second}
+	assert.Equal(t, defaults, RetryConfig{}.policy(defaults))
+	assert.Equal(t,
+		maestro.RetryPolicy{MaxAttempts: 1, BaseBackoff: time.Millisecond, MaxBackoff: time.Second, BudgetRatio: 0.1},
+		RetryConfig{MaxAttempts: 1, BudgetRatio: 0.1}.policy(defaults))
+}
+
+func TestRoutesRetryWithTheirOwnPolicy(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[strings.TrimSuffix(r.URL.Path, "/v1/mt")]++
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	routes, err := NewRoutingMap([]RouteConfig{
+		{TargetLang: "pt", Host: server.URL + "/pt"},
+		{TargetLang: "de", Host: server.URL + "/de", Retry: &RetryConfig{MaxAttempts: 1}},
+	})
+	assert.Nil(t, err)
+	p, err := NewMaestroProxyTranslator(Config{
+		Routes:          routes,
+		MaestroUsername: "user",
+		MaestroPassword: "pass",
+		Retry:           maestro.RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+	})
+	assert.Nil(t, err)
+
+	for _, lang := range []string{"pt", "de"} {
+		_, err := p.Handle(context.Background(), &model.MachineTranslationRequest{
+			Segments: []string{"Hello."},
+			Metadata: model.MTRequestMetadata{SourceLang: "en", TargetLang: lang},
+		})
+		assert.NotNil(t, err, lang)
+	}
+	assert.Equal(t, map[string]int{"/pt": 3, "/de": 1}, requests)
+}
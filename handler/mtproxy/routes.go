@@ -0,0 +1,278 @@
+package mtproxy
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Wildcard matches any value of a routing field, same as leaving it empty
+const Wildcard = "*"
+
+// Load balancing strategies of the routes with several endpoints
+const (
+	BalancerRoundRobin       = "round_robin"
+	BalancerLeastOutstanding = "least_outstanding"
+)
+
+// Endpoint is one of the maestro hosts serving a route
+type Endpoint struct {
+	Host string `mapstructure:"host" json:"host"`
+	// Weight is the share of the route requests, relative to the other endpoints
+	Weight int `mapstructure:"weight" json:"weight,omitempty"`
+}
+
+// Route are the endpoints serving a RoutingKey, and how requests are balanced among them
+type Route struct {
+	Endpoints []Endpoint
+	Balancer  string
+	// Auth overrides the default maestro credentials for the route endpoints
+	Auth *AuthConfig
+	// Retry overrides the default retry policy for the route endpoints
+	Retry *RetryConfig
+	// Hedge replaces the default hedge policy for the route
+	Hedge *HedgeConfig
+}
+
+// RouteConfig is a single entry of the `routes:` section of mtproxy.yaml, going to
+// either a single Host or to several Endpoints
+type RouteConfig struct {
+	SourceLang  string     `mapstructure:"source_lang" json:"source_lang,omitempty"`
+	TargetLang  string     `mapstructure:"target_lang" json:"target_lang,omitempty"`
+	ContentType string     `mapstructure:"content_type" json:"content_type,omitempty"`
+	ClientBrand string     `mapstructure:"client_brand" json:"client_brand,omitempty"`
+	Tone        string     `mapstructure:"tone" json:"tone,omitempty"`
+	Origin      string     `mapstructure:"origin" json:"origin,omitempty"`
+	Host        string     `mapstructure:"host" json:"host,omitempty"`
+	Endpoints   []Endpoint `mapstructure:"endpoints" json:"endpoints,omitempty"`
+	// Balancer is round_robin (the default) or least_outstanding
+	Balancer string `mapstructure:"balancer" json:"balancer,omitempty"`
+	// Auth is how to authenticate to the route endpoints, the default maestro credentials when unset
+	Auth *AuthConfig `mapstructure:"auth" json:"auth,omitempty"`
+	// Retry overrides the fields it sets of the default retry policy
+	Retry *RetryConfig `mapstructure:"retry" json:"retry,omitempty"`
+	// Hedge replaces the whole default hedge policy, an empty one disables hedging on the route
+	Hedge *HedgeConfig `mapstructure:"hedge" json:"hedge,omitempty"`
+}
+
+func (r RouteConfig) route() Route {
+	endpoints := r.Endpoints
+	if r.Host != "" {
+		endpoints = []Endpoint{{Host: r.Host}}
+	}
+	rt := Route{Balancer: r.Balancer, Endpoints: make([]Endpoint, len(endpoints)), Auth: r.Auth, Retry: r.Retry, Hedge: r.Hedge}
+	if rt.Balancer == "" {
+		rt.Balancer = BalancerRoundRobin
+	}
+	for i, e := range endpoints {
+		if e.Weight == 0 {
+			e.Weight = 1
+		}
+		rt.Endpoints[i] = e
+	}
+	return rt
+}
+
+func (r RouteConfig) key() RoutingKey {
+	return RoutingKey{
+		SourceLang:  field(r.SourceLang),
+		TargetLang:  field(r.TargetLang),
+		ContentType: field(r.ContentType),
+		ClientBrand: field(r.ClientBrand),
+		Tone:        field(r.Tone),
+		Origin:      field(r.Origin),
+	}
+}
+
+func field(v string) string {
+	v = strings.TrimSpace(v)
+	if v == Wildcard {
+		return ""
+	}
+	return v
+}
+
+// NewRoutingMap validates the configured routes and builds the routingMap used by
+// MaestroProxyTranslator, it fails on duplicated or unreachable-looking entries.
+func NewRoutingMap(routes []RouteConfig) (map[RoutingKey]Route, error) {
+	if len(routes) < 1 {
+		return nil, fmt.Errorf("routes: got zero entries")
+	}
+	routingMap := make(map[RoutingKey]Route, len(routes))
+	// a host has a single maestro client, whatever the route
+	hostRoutes := make(map[string]Route)
+	for i, r := range routes {
+		k := r.key()
+		if err := validateRoute(r); err != nil {
+			return nil, fmt.Errorf("routes[%v] %+v: %w", i, k, err)
+		}
+		if prev, found := routingMap[k]; found {
+			return nil, fmt.Errorf("routes[%v] %+v: duplicate route, already going to %v", i, k, prev.Endpoints)
+		}
+		rt := r.route()
+		for _, e := range rt.Endpoints {
+			if prev, found := hostRoutes[e.Host]; found && !sameClient(prev, rt) {
+				return nil, fmt.Errorf("routes[%v] %+v: host %q already used with other auth, retry or hedge", i, k, e.Host)
+			}
+			hostRoutes[e.Host] = rt
+		}
+		routingMap[k] = rt
+	}
+	return routingMap, nil
+}
+
+func validateRoute(r RouteConfig) error {
+	if k := r.key(); k.SourceLang != "" && k.SourceLang == k.TargetLang {
+		return fmt.Errorf("unreachable route, source and target language are the same")
+	}
+	switch {
+	case r.Host == "" && len(r.Endpoints) == 0:
+		return fmt.Errorf("missing host")
+	case r.Host != "" && len(r.Endpoints) > 0:
+		return fmt.Errorf("set either host or endpoints, not both")
+	}
+	if r.Balancer != "" && r.Balancer != BalancerRoundRobin && r.Balancer != BalancerLeastOutstanding {
+		return fmt.Errorf("unknown balancer %q", r.Balancer)
+	}
+	if r.Auth != nil {
+		if err := r.Auth.validate(); err != nil {
+			return err
+		}
+	}
+	if r.Retry != nil {
+		if err := r.Retry.validate(); err != nil {
+			return err
+		}
+	}
+	if r.Hedge != nil {
+		if err := r.Hedge.validate(); err != nil {
+			return err
+		}
+	}
+	seen := make(map[string]bool)
+	for _, e := range r.route().Endpoints {
+		if err := validateHost(e.Host); err != nil {
+			return err
+		}
+		if e.Weight < 0 {
+			return fmt.Errorf("host %q: negative weight", e.Host)
+		}
+		if seen[e.Host] {
+			return fmt.Errorf("host %q: duplicate endpoint", e.Host)
+		}
+		seen[e.Host] = true
+	}
+	return nil
+}
+
+// sameClient is true when the routes authenticate, retry and hedge the same way
+func sameClient(a, b Route) bool {
+	sameAuth := a.Auth == b.Auth || (a.Auth != nil && b.Auth != nil && *a.Auth == *b.Auth)
+	sameRetry := a.Retry == b.Retry || (a.Retry != nil && b.Retry != nil && *a.Retry == *b.Retry)
+	sameHedge := a.Hedge == b.Hedge || (a.Hedge != nil && b.Hedge != nil && *a.Hedge == *b.Hedge)
+	return sameAuth && sameRetry && sameHedge
+}
+
+func validateHost(host string) error {
+	if strings.TrimSpace(host) == "" {
+		return fmt.Errorf("missing host")
+	}
+	if strings.ContainsAny(host, " \t\n") {
+		return fmt.Errorf("invalid host %q, contains whitespace", host)
+	}
+	u, err := url.Parse(serviceURL(host))
+	if err != nil {
+		return fmt.Errorf("invalid host %q: %w", host, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid host %q, unsupported scheme %q", host, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("invalid host %q, no hostname", host)
+	}
+	return nil
+}
+
+// fields lists the RoutingKey values by decreasing priority, it is used to break ties
+// between routes that set the same number of fields
+func (k RoutingKey) fields() []string {
+	return []string{k.SourceLang, k.TargetLang, k.ContentType, k.ClientBrand, k.Tone, k.Origin}
+}
+
+// matches is true when every non wildcard field of k equals the one from req
+func (k RoutingKey) matches(req RoutingKey) bool {
+	reqFields := req.fields()
+	for i, v := range k.fields() {
+		if v != "" && v != reqFields[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// specificity counts the non wildcard fields and flags which ones are set,
+// higher priority fields have higher bits.
+func (k RoutingKey) specificity() (count, mask int) {
+	fields := k.fields()
+	for i, v := range fields {
+		if v != "" {
+			count++
+			mask |= 1 << (len(fields) - 1 - i)
+		}
+	}
+	return count, mask
+}
+
+type route struct {
+	key  RoutingKey
+	pool *endpointPool
+}
+
+// router picks the most specific route matching a request: the one with the most
+// non wildcard fields, ties are broken by field priority (see RoutingKey.fields).
+// Two matching routes can't share both, so the choice is deterministic.
+type router struct {
+	routes []route
+}
+
+func newRouter(routingMap map[RoutingKey]Route, upstreams *upstreams, maxConcurrency int) *router {
+	routes := make([]route, 0, len(routingMap))
+	for k, v := range routingMap {
+		routes = append(routes, route{key: k, pool: newEndpointPool(v, upstreams, maxConcurrency)})
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		ci, mi := routes[i].key.specificity()
+		cj, mj := routes[j].key.specificity()
+		if ci != cj {
+			return ci > cj
+		}
+		return mi > mj
+	})
+	return &router{routes: routes}
+}
+
+func (r *router) route(k RoutingKey) (*endpointPool, bool) {
+	for _, rt := range r.routes {
+		if rt.key.matches(k) {
+			return rt.pool, true
+		}
+	}
+	return nil, false
+}
+
+// hostsOf lists the distinct endpoint hosts of the routes
+func hostsOf(routingMap map[RoutingKey]Route) []string {
+	var hosts []string
+	seen := make(map[string]bool)
+	for _, r := range routingMap {
+		for _, e := range r.Endpoints {
+			if !seen[e.Host] {
+				seen[e.Host] = true
+				hosts = append(hosts, e.Host)
+			}
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
@@ -0,0 +1,122 @@
+//go:build unit
+// +build unit
+
+package mtproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testRouter(routingMap map[RoutingKey]Route) *router {
+	return newRouter(routingMap, newUpstreams(hostsOf(routingMap), OutlierConfig{}), 0)
+}
+
+func TestNewRoutingMap(t *testing.T) {
+	routingMap, err := NewRoutingMap([]RouteConfig{
+		{SourceLang: "en", TargetLang: "pt", Host: "bananas.foo"},
+		{Host: "https://bar.foo:8080"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[RoutingKey]Route{
+		{SourceLang: "en", TargetLang: "pt"}: hostRoute("bananas.foo"),
+		{}:                                   hostRoute("https://bar.foo:8080"),
+	}, routingMap)
+}
+
+func TestNewRoutingMapEndpoints(t *testing.T) {
+	routingMap, err := NewRoutingMap([]RouteConfig{{
+		SourceLang: "en",
+		Balancer:   BalancerLeastOutstanding,
+		Endpoints:  []Endpoint{{Host: "a.foo", Weight: 3}, {Host: "b.foo"}},
+	}})
+	assert.Nil(t, err)
+	assert.Equal(t, Route{
+		Endpoints: []Endpoint{{Host: "a.foo", Weight: 3}, {Host: "b.foo", Weight: 1}},
+		Balancer:  BalancerLeastOutstanding,
+	}, routingMap[RoutingKey{SourceLang: "en"}])
+}
+
+func TestNewRoutingMapErrors(t *testing.T) {
+	tests := map[string][]RouteConfig{
+		"empty":              {},
+		"duplicate":          {{SourceLang: "en", TargetLang: "pt", Host: "a.foo"}, {SourceLang: "en", TargetLang: "pt", Host: "b.foo"}},
+		"no host":            {{SourceLang: "en", TargetLang: "pt"}},
+		"spaces":             {{SourceLang: "en", TargetLang: "pt", Host: "a foo"}},
+		"scheme":             {{SourceLang: "en", TargetLang: "pt", Host: "ftp://a.foo"}},
+		"same lang":          {{SourceLang: "en", TargetLang: "en", Host: "a.foo"}},
+		"host and endpoints": {{Host: "a.foo", Endpoints: []Endpoint{{Host: "b.foo"}}}},
+		"bad endpoint":       {{Endpoints: []Endpoint{{Host: "b.foo"}, {Host: "ftp://c.foo"}}}},
+		"dup endpoint":       {{Endpoints: []Endpoint{{Host: "b.foo"}, {Host: "b.foo"}}}},
+		"negative weight":    {{Endpoints: []Endpoint{{Host: "b.foo", Weight: -1}}}},
+		"balancer":           {{Host: "a.foo", Balancer: "random"}},
+		"auth type":          {{Host: "a.foo", Auth: &AuthConfig{Type: "digest"}}},
+		"auth password":      {{Host: "a.foo", Auth: &AuthConfig{Type: AuthBasic, Username: "u"}}},
+		"auth token":         {{Host: "a.foo", Auth: &AuthConfig{Type: AuthBearer}}},
+		"auth key":           {{Host: "a.foo", Auth: &AuthConfig{Type: AuthMTLS, CertFile: "c.pem"}}},
+		"retry attempts":     {{Host: "a.foo", Retry: &RetryConfig{MaxAttempts: -1}}},
+		"retry backoff":      {{Host: "a.foo", Retry: &RetryConfig{BaseBackoff: time.Second, MaxBackoff: time.Millisecond}}},
+		"retry per host": {
+			{SourceLang: "en", Host: "a.foo", Retry: &RetryConfig{MaxAttempts: 1}},
+			{SourceLang: "de", Host: "a.foo", Retry: &RetryConfig{MaxAttempts: 2}},
+		},
+		"hedge delay":      {{Host: "a.foo", Hedge: &HedgeConfig{Delay: -time.Second}}},
+		"hedge percentile": {{Host: "a.foo", Hedge: &HedgeConfig{Percentile: 95}}},
+		"hedge per host": {
+			{SourceLang: "en", Host: "a.foo", Hedge: &HedgeConfig{Delay: time.Second}},
+			{SourceLang: "de", Host: "a.foo"},
+		},
+		"auth per host": {
+			{SourceLang: "en", Host: "a.foo", Auth: &AuthConfig{Type: AuthBearer, Token: "t"}},
+			{SourceLang: "de", Host: "a.foo"},
+		},
+	}
+	for name, routes := range tests {
+		_, err := NewRoutingMap(routes)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestRouterMostSpecificMatch(t *testing.T) {
+	routingMap, err := NewRoutingMap([]RouteConfig{
+		{Host: "generic.foo"},
+		{SourceLang: "en", TargetLang: "pt", Host: "en-pt.foo"},
+		{SourceLang: "en", TargetLang: "pt", ContentType: "chat", Host: "en-pt-chat.foo"},
+		{SourceLang: "*", TargetLang: "pt", ContentType: "chat", Host: "any-pt-chat.foo"},
+		{SourceLang: "en", TargetLang: "*", ContentType: "chat", Host: "en-any-chat.foo"},
+		{ContentType: "chat", ClientBrand: "acme", Host: "acme-chat.foo"},
+	})
+	assert.Nil(t, err)
+	r := testRouter(routingMap)
+
+	tests := []struct {
+		key      RoutingKey
+		expected string
+	}{
+		{RoutingKey{SourceLang: "de", TargetLang: "fr"}, "generic.foo"},
+		{RoutingKey{SourceLang: "en", TargetLang: "pt"}, "en-pt.foo"},
+		{RoutingKey{SourceLang: "en", TargetLang: "pt", ContentType: "chat", Tone: "formal"}, "en-pt-chat.foo"},
+		{RoutingKey{SourceLang: "de", TargetLang: "pt", ContentType: "chat"}, "any-pt-chat.foo"},
+		{RoutingKey{SourceLang: "en", TargetLang: "de", ContentType: "chat"}, "en-any-chat.foo"},
+		// same count of fields, source_lang has priority over client_brand
+		{RoutingKey{SourceLang: "en", TargetLang: "de", ContentType: "chat", ClientBrand: "acme"}, "en-any-chat.foo"},
+		{RoutingKey{SourceLang: "de", TargetLang: "fr", ContentType: "chat", ClientBrand: "acme"}, "acme-chat.foo"},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 10; i++ { // map iteration order must not matter
+			pool, found := testRouter(routingMap).route(tt.key)
+			assert.True(t, found)
+			assert.Equal(t, tt.expected, pool.endpoints[0].upstream.host, "%+v", tt.key)
+		}
+		pool, _ := r.route(tt.key)
+		assert.Equal(t, tt.expected, pool.endpoints[0].upstream.host)
+	}
+}
+
+func TestRouterNoMatch(t *testing.T) {
+	r := testRouter(map[RoutingKey]Route{{SourceLang: "en"}: hostRoute("en.foo")})
+	_, found := r.route(RoutingKey{SourceLang: "de", TargetLang: "en"})
+	assert.False(t, found)
+}
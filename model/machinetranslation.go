@@ -1,13 +1,22 @@
 package model
 
+// Well known keys of MTRequestMetadata.Metadata, forwarded to the MT engines
+const (
+	MetadataContentType    = "content_type"
+	MetadataOrigin         = "origin"
+	MetadataClientBrand    = "client_brand"
+	MetadataClientUsername = "client_username"
+	MetadataTone           = "tone"
+	MetadataGlossaryID     = "glossary_id"
+)
+
 type MachineTranslationRequest struct {
 	ID       string            `json:"id,omitempty"`
 	Segments []string          `json:"segments,omitempty"`
 	Metadata MTRequestMetadata `json:"metadata,omitempty"`
-}
-
-func (m *MachineTranslationRequest) HasError() error {
-	return nil
+	// AllowPartial opts in to responses with the segments that could be translated,
+	// even when others failed. SegmentStatus then says which ones.
+	AllowPartial bool `json:"allow_partial,omitempty"`
 }
 
 type MTRequestMetadata struct {
@@ -20,6 +29,30 @@ type MachineTranslationResponse struct {
 	RequestID       string            `json:"request_id,omitempty"`
 	TargetSegments  []TargetSegment   `json:"target_segments,omitempty"`
 	RequestMetadata MTRequestMetadata `json:"request_metadata,omitempty"`
+	// SegmentStatus is set for AllowPartial requests, one per TargetSegments
+	SegmentStatus []SegmentStatus `json:"segment_status,omitempty"`
+}
+
+const (
+	SegmentOK     = "ok"
+	SegmentFailed = "failed"
+)
+
+// SegmentStatus is the outcome of translating a segment
+type SegmentStatus struct {
+	Status string `json:"status"`
+	// ErrorCode is one of the handler.Code* constants, for failed segments
+	ErrorCode string `json:"error_code,omitempty"`
+}
+
+// IsPartial is true when some of the segments failed to translate
+func (r *MachineTranslationResponse) IsPartial() bool {
+	for _, s := range r.SegmentStatus {
+		if s.Status != SegmentOK {
+			return true
+		}
+	}
+	return false
 }
 
 type TargetSegment string
@@ -41,6 +41,57 @@ type MTResponse struct {
 	CanSkipHumanEditionReason string         `json:"can_skip_reason,omitempty" bson:"can_skip_reason,omitempty"`
 }
 
+// MTQERequest is an MTRequest that also scores the translation quality
+type MTQERequest MTRequest
+
+// MTQEResponse is an MTResponse with the QualityScore set
+type MTQEResponse MTResponse
+
+// PivotedMTRequest translates through PivotLanguage, for pairs without a direct engine
+type PivotedMTRequest struct {
+	MTRequest
+	PivotLanguage string `json:"pivot_language" bson:"pivot_language"`
+}
+
+type PivotedMTResponse struct {
+	UID                       string           `json:"uid" bson:"uid"`
+	Text                      string           `json:"text,omitempty" bson:"text"`
+	TranslatedContent         string           `json:"translated_content" bson:"translated_content"`
+	TranslatedData            TranslatedData   `json:"translated_data" bson:"translated_data"`
+	PivotTranslatedContent    string           `json:"pivot_translated_content,omitempty" bson:"pivot_translated_content"`
+	DebugInfo                 PivotedDebugInfo `json:"debug_info,omitempty" bson:"debug_info"`
+	QualityScore              float64          `json:"quality_score,omitempty" bson:"quality_score,omitempty"`
+	CanSkipHumanEdition       bool             `json:"can_skip_human_edition,omitempty" bson:"can_skip_human_edition,omitempty"`
+	CanSkipHumanEditionReason string           `json:"can_skip_reason,omitempty" bson:"can_skip_reason,omitempty"`
+}
+
+// PivotedMTQERequest is a PivotedMTRequest that also scores the translation quality
+type PivotedMTQERequest PivotedMTRequest
+
+// PivotedMTQEResponse is a PivotedMTResponse with the QualityScore set
+type PivotedMTQEResponse PivotedMTResponse
+
+// RebuildRequest rebuilds the translated content from the (human edited) TranslatedData nuggets
+type RebuildRequest struct {
+	UID string `json:"uid" bson:"uid"`
+	// ContentType isn't sent, maestro takes it from the service the request goes to
+	ContentType    string         `json:"-" bson:"content_type"`
+	SourceLanguage string         `json:"source_language" bson:"source_language"`
+	TargetLanguage string         `json:"target_language" bson:"target_language"`
+	Text           string         `json:"text" bson:"text"`
+	TranslatedData TranslatedData `json:"translated_data" bson:"translated_data"`
+}
+
+type RebuildResponse MTResponse
+
+// PivotedRebuildRequest is the RebuildRequest of a PivotedMTRequest
+type PivotedRebuildRequest struct {
+	RebuildRequest
+	PivotLanguage string `json:"pivot_language" bson:"pivot_language"`
+}
+
+type PivotedRebuildResponse PivotedMTResponse
+
 type Failure struct {
 	Context  []FailureContext `json:"context,omitempty" bson:"context,omitempty"`
 	Category string           `json:"category,omitempty" bson:"category,omitempty"`
@@ -185,7 +236,12 @@ type MTMetric struct {
 // ParseMTResponse can decode the complex mt_response
 // TODO(msf): handle the nested dicts inside Nuggets correctly
 func ParseMTResponse(respBuffer []byte, resp *MTResponse) error {
-	err := json.NewDecoder(bytes.NewReader(respBuffer)).Decode(&resp)
+	return ParseResponse(respBuffer, resp)
+}
+
+// ParseResponse decodes the response of any maestro flow into resp
+func ParseResponse(respBuffer []byte, resp interface{}) error {
+	err := json.NewDecoder(bytes.NewReader(respBuffer)).Decode(resp)
 	if err != nil {
 		return errors.Wrapf(err, "original payload: %v", string(respBuffer))
 	}
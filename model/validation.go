@@ -0,0 +1,101 @@
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Codes of the FieldError, for clients to act on
+const (
+	CodeRequired      = "required"
+	CodeInvalidFormat = "invalid_format"
+	CodeSameLanguage  = "same_language"
+	CodeTooMany       = "too_many"
+	CodeTooLong       = "too_long"
+)
+
+// language codes like en, pt-BR, zh_Hant or es-419
+var languageCode = regexp.MustCompile(`^[a-zA-Z]{2,3}([-_][a-zA-Z0-9]{2,8})*$`)
+
+// RequestLimits configures the MachineTranslationRequest validation, zero limits are unlimited
+type RequestLimits struct {
+	// AllowPassthrough accepts requests with the same source and target language
+	AllowPassthrough bool
+	MaxSegments      int
+	// MaxSegmentChars and MaxTotalChars count unicode characters
+	MaxSegmentChars int
+	MaxTotalChars   int
+}
+
+// FieldError is a problem with one field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors are all the problems found with a request
+type ValidationErrors []FieldError
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, e := range v {
+		msgs[i] = e.Field + ": " + e.Message
+	}
+	return "invalid request: " + strings.Join(msgs, ", ")
+}
+
+// HasError returns ValidationErrors listing every problem of the request, or nil
+func (m *MachineTranslationRequest) HasError(limits RequestLimits) error {
+	var errs ValidationErrors
+	add := func(field, code, format string, args ...interface{}) {
+		errs = append(errs, FieldError{Field: field, Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+
+	langs := []struct{ field, code string }{
+		{"metadata.source_lang", m.Metadata.SourceLang},
+		{"metadata.target_lang", m.Metadata.TargetLang},
+	}
+	for _, l := range langs {
+		switch {
+		case l.code == "":
+			add(l.field, CodeRequired, "is required")
+		case !languageCode.MatchString(l.code):
+			add(l.field, CodeInvalidFormat, "%q is not a language code", l.code)
+		}
+	}
+	if !limits.AllowPassthrough && m.IsPassthrough() {
+		add("metadata.target_lang", CodeSameLanguage, "must differ from source_lang")
+	}
+
+	if len(m.Segments) == 0 {
+		add("segments", CodeRequired, "at least one segment is required")
+	}
+	if limits.MaxSegments > 0 && len(m.Segments) > limits.MaxSegments {
+		add("segments", CodeTooMany, "%v segments, the limit is %v", len(m.Segments), limits.MaxSegments)
+	}
+	total := 0
+	for i, s := range m.Segments {
+		n := utf8.RuneCountInString(s)
+		total += n
+		if limits.MaxSegmentChars > 0 && n > limits.MaxSegmentChars {
+			add(fmt.Sprintf("segments[%d]", i), CodeTooLong,
+				"%v characters, the limit is %v", n, limits.MaxSegmentChars)
+		}
+	}
+	if limits.MaxTotalChars > 0 && total > limits.MaxTotalChars {
+		add("segments", CodeTooLong, "%v characters in total, the limit is %v", total, limits.MaxTotalChars)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// IsPassthrough is true when the source and target languages are the same
+func (m *MachineTranslationRequest) IsPassthrough() bool {
+	return m.Metadata.SourceLang != "" && strings.EqualFold(m.Metadata.SourceLang, m.Metadata.TargetLang)
+}
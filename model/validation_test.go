@@ -0,0 +1,71 @@
+//go:build unit
+// +build unit
+
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHasError(t *testing.T) {
+	md := MTRequestMetadata{SourceLang: "en", TargetLang: "pt-BR"}
+	limits := RequestLimits{MaxSegments: 2, MaxSegmentChars: 5, MaxTotalChars: 8}
+
+	for name, tc := range map[string]struct {
+		req   MachineTranslationRequest
+		codes map[string]string
+	}{
+		"valid": {
+			req: MachineTranslationRequest{Segments: []string{"Olá", "Adeus"}, Metadata: md},
+		},
+		"missing languages and segments": {
+			req: MachineTranslationRequest{},
+			codes: map[string]string{
+				"metadata.source_lang": CodeRequired,
+				"metadata.target_lang": CodeRequired,
+				"segments":             CodeRequired,
+			},
+		},
+		"malformed language": {
+			req:   MachineTranslationRequest{Segments: []string{"a"}, Metadata: MTRequestMetadata{SourceLang: "en", TargetLang: "p"}},
+			codes: map[string]string{"metadata.target_lang": CodeInvalidFormat},
+		},
+		"same language": {
+			req:   MachineTranslationRequest{Segments: []string{"a"}, Metadata: MTRequestMetadata{SourceLang: "pt", TargetLang: "PT"}},
+			codes: map[string]string{"metadata.target_lang": CodeSameLanguage},
+		},
+		"too many segments": {
+			req:   MachineTranslationRequest{Segments: []string{"a", "b", "c"}, Metadata: md},
+			codes: map[string]string{"segments": CodeTooMany},
+		},
+		"too long": {
+			req: MachineTranslationRequest{Segments: []string{"abcdef", "abc"}, Metadata: md},
+			codes: map[string]string{
+				"segments[0]": CodeTooLong,
+				"segments":    CodeTooLong,
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := tc.req.HasError(limits)
+			if tc.codes == nil {
+				assert.Nil(t, err)
+				return
+			}
+			codes := map[string]string{}
+			for _, e := range err.(ValidationErrors) {
+				codes[e.Field] = e.Code
+			}
+			assert.Equal(t, tc.codes, codes)
+		})
+	}
+}
+
+func TestHasErrorPassthrough(t *testing.T) {
+	req := MachineTranslationRequest{Segments: []string{"a"}, Metadata: MTRequestMetadata{SourceLang: "en", TargetLang: "en"}}
+	assert.NotNil(t, req.HasError(RequestLimits{}))
+	assert.Nil(t, req.HasError(RequestLimits{AllowPassthrough: true}))
+	assert.True(t, req.IsPassthrough())
+}
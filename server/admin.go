@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/msf/cachingproxy/model"
+)
+
+// admin endpoints are meant for a separate, internal only, listener.
+// Segments are identified by query params:
+//   ?source_lang=en&target_lang=pt&text=Hello&metadata[content_type]=chat
+
+func segmentQuery(c *gin.Context) (model.MTRequestMetadata, string, bool) {
+	md := model.MTRequestMetadata{
+		SourceLang: c.Query("source_lang"),
+		TargetLang: c.Query("target_lang"),
+	}
+	if m := c.QueryMap("metadata"); len(m) > 0 {
+		md.Metadata = m
+	}
+	text := c.Query("text")
+	if md.SourceLang == "" || md.TargetLang == "" || text == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "source_lang, target_lang and text are required",
+		})
+		return md, text, false
+	}
+	return md, text, true
+}
+
+// CacheLookup returns the cached translation of a segment
+func (s *GinServer) CacheLookup(c *gin.Context) {
+	md, text, ok := segmentQuery(c)
+	if !ok {
+		return
+	}
+	entry, found := s.cache.Lookup(md, text)
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "segment not cached"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"target":      entry.Target,
+		"tier":        entry.Tier,
+		"ttl_seconds": int64(entry.TTL.Seconds()),
+	})
+}
+
+// CacheDelete removes a segment from the cache
+func (s *GinServer) CacheDelete(c *gin.Context) {
+	md, text, ok := segmentQuery(c)
+	if !ok {
+		return
+	}
+	if err := s.cache.Delete(md, []string{text}); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// CachePurge removes every segment of the :source_lang/:target_lang pair from the cache
+func (s *GinServer) CachePurge(c *gin.Context) {
+	purged, err := s.cache.PurgeLanguagePair(c.Param("source_lang"), c.Param("target_lang"))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"removed": purged})
+}
+
+// CacheStats returns the cache hit/miss/eviction metrics
+func (s *GinServer) CacheStats(c *gin.Context) {
+	c.JSON(http.StatusOK, s.cache.Stats())
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/msf/cachingproxy/handler"
+	"github.com/msf/cachingproxy/model"
+)
+
+// statusClientClosedRequest is nginx's status for the requests the client gave up on
+const statusClientClosedRequest = 499
+
+// ErrorBody is the body of every error reply
+type ErrorBody struct {
+	// Code is one of the handler.Code* constants
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+	// Fields lists the problems of an invalid request
+	Fields []model.FieldError `json:"fields,omitempty"`
+}
+
+// malformedError is a request body that isn't valid json
+type malformedError struct {
+	err error
+}
+
+func (e *malformedError) Error() string {
+	return "malformed json: " + e.err.Error()
+}
+
+func (e *malformedError) Unwrap() error {
+	return e.err
+}
+
+// errorReply maps the MT errors to their http status and error body. Server side
+// failures get a generic message, their details are only logged.
+func errorReply(err error, requestID string) Reply {
+	body := ErrorBody{RequestID: requestID, Code: handler.ErrorCode(err)}
+	var status int
+
+	var malformed *malformedError
+	if errors.As(err, &malformed) {
+		return Reply{Status: http.StatusBadRequest, Err: err, Body: ErrorBody{
+			RequestID: requestID, Code: handler.CodeValidation, Message: err.Error(),
+		}}
+	}
+	switch body.Code {
+	case handler.CodeValidation:
+		status, body.Message = http.StatusBadRequest, "invalid request"
+		var fields model.ValidationErrors
+		errors.As(err, &fields)
+		body.Fields = fields
+	case handler.CodeNoRoute:
+		status, body.Message = http.StatusNotFound, err.Error()
+	case handler.CodeUpstreamTimeout:
+		status, body.Message = http.StatusGatewayTimeout, "the machine translation engine timed out"
+	case handler.CodeUpstreamUnavailable:
+		status, body.Message = http.StatusServiceUnavailable, "the machine translation engine is unavailable"
+	case handler.CodeUpstreamFailed:
+		status, body.Message = http.StatusBadGateway, "the machine translation engine failed"
+	case handler.CodeCacheFailed:
+		status, body.Message = http.StatusInternalServerError, "the translation cache failed"
+	case handler.CodeTimeout:
+		status, body.Message = http.StatusGatewayTimeout, "the request timed out"
+	case handler.CodeCancelled:
+		status, body.Message = statusClientClosedRequest, "the request was cancelled"
+	default:
+		status, body.Message = http.StatusInternalServerError, "internal error"
+	}
+	return Reply{Status: status, Body: body, Err: err}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// still unique enough to correlate the logs
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
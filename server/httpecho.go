@@ -5,11 +5,27 @@ import (
 
 	"github.com/labstack/echo/v4"
 	"github.com/msf/cachingproxy/handler"
+	"github.com/msf/cachingproxy/handler/mtcache"
+	"github.com/msf/cachingproxy/handler/mtproxy"
 	"github.com/msf/cachingproxy/model"
 )
 
+type EchoServer struct {
+	*MTService
+}
+
+func NewEchoServer(cacheConfig mtcache.Config,
+	proxyConfig mtproxy.Config,
+	limits model.RequestLimits,
+) (*EchoServer, error) {
+	svc, err := NewMTService(cacheConfig, proxyConfig, limits)
+	if err != nil {
+		return nil, err
+	}
+	return &EchoServer{MTService: svc}, nil
+}
+
 func EchoPing(c echo.Context) error {
-	c.B
 	type r struct {
 		M string `json:"message"`
 	}
@@ -27,3 +43,14 @@ func EchoMessage(c echo.Context) error {
 	}
 	return c.JSON(http.StatusOK, r)
 }
+
+func (s *EchoServer) MachineTranslate(c echo.Context) error {
+	return echoReply(c, s.MTService.MachineTranslate(c.Request().Context(), c.Request().Body))
+}
+
+func echoReply(c echo.Context, r Reply) error {
+	if r.Err != nil {
+		c.Logger().Error(r.Err)
+	}
+	return c.JSON(r.Status, r.Body)
+}
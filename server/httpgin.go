@@ -5,26 +5,24 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/msf/cachingproxy/handler"
-	mt "github.com/msf/cachingproxy/handler/mt"
 	"github.com/msf/cachingproxy/handler/mtcache"
 	"github.com/msf/cachingproxy/handler/mtproxy"
 	"github.com/msf/cachingproxy/model"
 )
 
 type GinServer struct {
-	mtHandler handler.MachineTranslationHandler
+	*MTService
 }
 
 func NewGinServer(cacheConfig mtcache.Config,
-	routingMap map[mtproxy.RoutingKey]string,
+	proxyConfig mtproxy.Config,
+	limits model.RequestLimits,
 ) (*GinServer, error) {
-	mtH, err := mt.NewCachingMTHandler(cacheConfig, routingMap)
+	svc, err := NewMTService(cacheConfig, proxyConfig, limits)
 	if err != nil {
 		return nil, err
 	}
-	return &GinServer{
-		mtHandler: mtH,
-	}, nil
+	return &GinServer{MTService: svc}, nil
 }
 
 func (s *GinServer) Ping(c *gin.Context) {
@@ -47,16 +45,14 @@ func (s *GinServer) Message(c *gin.Context) {
 }
 
 func (s *GinServer) MachineTranslate(c *gin.Context) {
-	var req model.MachineTranslationRequest
-	if err := c.BindJSON(&req); err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
-		return
-	}
+	ginReply(c, s.MTService.MachineTranslate(c.Request.Context(), c.Request.Body))
+}
 
-	r, err := s.mtHandler.Handle(&req)
-	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+func ginReply(c *gin.Context, r Reply) {
+	if r.Err != nil {
+		c.Error(r.Err)
+		c.AbortWithStatusJSON(r.Status, r.Body)
 		return
 	}
-	c.JSON(http.StatusOK, r)
+	c.JSON(r.Status, r.Body)
 }
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "mtproxy",
+	Subsystem: "http",
+	Name:      "request_duration_seconds",
+	Help:      "Latency of the http requests, by method, route and status code.",
+	Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 20, 40},
+}, []string{"method", "path", "code"})
+
+func init() {
+	prometheus.MustRegister(requestDuration)
+}
+
+// GinMetrics is a middleware recording the latency of every request
+func GinMetrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		path := c.FullPath()
+		if path == "" {
+			path = "unmatched" // keeps 404 paths out of the labels
+		}
+		requestDuration.WithLabelValues(c.Request.Method, path, strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+// GinPrometheus serves the prometheus metrics
+func GinPrometheus() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
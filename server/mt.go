@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/msf/cachingproxy/handler"
+	mt "github.com/msf/cachingproxy/handler/mt"
+	"github.com/msf/cachingproxy/handler/mtcache"
+	"github.com/msf/cachingproxy/handler/mtproxy"
+	"github.com/msf/cachingproxy/model"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MTService is the framework neutral core of the machine translation endpoints.
+// It binds, validates and handles the requests and decides on the response, the gin
+// and echo servers only adapt their request/response types to it.
+type MTService struct {
+	mtHandler handler.MachineTranslationHandler
+	cache     mtcache.MachineTranslationCache
+	limits    model.RequestLimits
+}
+
+// Reply is the response to write back, whatever the framework
+type Reply struct {
+	Status int
+	Body   interface{}
+	// Err is the failure behind an error reply, for the framework to log
+	Err error
+}
+
+// drainer is implemented by handlers running background work that must finish
+// before the cache is closed
+type drainer interface {
+	Drain(ctx context.Context) error
+}
+
+func NewMTService(cacheConfig mtcache.Config,
+	proxyConfig mtproxy.Config,
+	limits model.RequestLimits,
+) (*MTService, error) {
+	cache, err := mtcache.NewCachingSegmentTranslator(cacheConfig)
+	if err != nil {
+		return nil, err
+	}
+	mtH, err := mt.NewCachingMTHandler(cache, proxyConfig)
+	if err != nil {
+		cache.Close()
+		return nil, err
+	}
+	return &MTService{
+		mtHandler: mtH,
+		cache:     cache,
+		limits:    limits,
+	}, nil
+}
+
+// Close releases the cache, persisting it when configured to
+func (s *MTService) Close() error {
+	return s.cache.Close()
+}
+
+// Shutdown waits, until ctx is done, for the background work of the handlers and then
+// closes the cache. The cache is closed even if the background work didn't finish.
+func (s *MTService) Shutdown(ctx context.Context) error {
+	var err error
+	if d, ok := s.mtHandler.(drainer); ok {
+		err = d.Drain(ctx)
+	}
+	if er := s.Close(); er != nil && err == nil {
+		err = er
+	}
+	return err
+}
+
+// RegisterMetrics exports the cache metrics of the service
+func (s *MTService) RegisterMetrics(reg prometheus.Registerer) error {
+	return reg.Register(mtcache.NewStatsCollector(s.cache))
+}
+
+// MachineTranslate handles a json encoded model.MachineTranslationRequest, ctx is the
+// http request context so the translation stops once the client goes away
+func (s *MTService) MachineTranslate(ctx context.Context, body io.Reader) Reply {
+	var req model.MachineTranslationRequest
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		return errorReply(&malformedError{err}, newRequestID())
+	}
+	if req.ID == "" {
+		// every reply, and log line, can be traced back to a request
+		req.ID = newRequestID()
+	}
+	if err := req.HasError(s.limits); err != nil {
+		return errorReply(err, req.ID)
+	}
+	if req.IsPassthrough() {
+		return Reply{Status: http.StatusOK, Body: passthrough(&req)}
+	}
+
+	r, err := s.mtHandler.Handle(ctx, &req)
+	if err != nil {
+		return errorReply(err, req.ID)
+	}
+	if r.IsPartial() {
+		return Reply{Status: http.StatusMultiStatus, Body: r}
+	}
+	return Reply{Status: http.StatusOK, Body: r}
+}
+
+// passthrough "translates" a request into its own language, by returning the sources
+func passthrough(req *model.MachineTranslationRequest) *model.MachineTranslationResponse {
+	targets := make([]model.TargetSegment, len(req.Segments))
+	for i, s := range req.Segments {
+		targets[i] = model.TargetSegment(s)
+	}
+	return &model.MachineTranslationResponse{
+		RequestID:       req.ID,
+		TargetSegments:  targets,
+		RequestMetadata: req.Metadata,
+	}
+}
@@ -0,0 +1,142 @@
+//go:build unit
+// +build unit
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/labstack/echo/v4"
+	"github.com/msf/cachingproxy/handler"
+	"github.com/msf/cachingproxy/model"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeHandler struct {
+	err    error
+	status []model.SegmentStatus
+}
+
+func (f *fakeHandler) Handle(
+	ctx context.Context, req *model.MachineTranslationRequest,
+) (*model.MachineTranslationResponse, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &model.MachineTranslationResponse{
+		RequestID:      req.ID,
+		TargetSegments: []model.TargetSegment{"Olá"},
+		SegmentStatus:  f.status,
+	}, nil
+}
+
+// serveBoth sends the same request body to the gin and echo endpoints
+func serveBoth(t *testing.T, svc *MTService, body string) (ginRec, echoRec *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	g := gin.New()
+	g.POST("/v1/machine_translate", (&GinServer{MTService: svc}).MachineTranslate)
+	e := echo.New()
+	e.POST("/v1/machine_translate", (&EchoServer{MTService: svc}).MachineTranslate)
+
+	ginRec, echoRec = httptest.NewRecorder(), httptest.NewRecorder()
+	g.ServeHTTP(ginRec, httptest.NewRequest(http.MethodPost, "/v1/machine_translate", strings.NewReader(body)))
+	e.ServeHTTP(echoRec, httptest.NewRequest(http.MethodPost, "/v1/machine_translate", strings.NewReader(body)))
+	return ginRec, echoRec
+}
+
+// withoutRequestID decodes a reply, dropping the request_id generated for requests without one
+func withoutRequestID(t *testing.T, rec *httptest.ResponseRecorder) map[string]interface{} {
+	var body map[string]interface{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	if rec.Code != http.StatusOK {
+		assert.NotEmpty(t, body["request_id"])
+		delete(body, "request_id")
+	}
+	return body
+}
+
+const enPt = `"metadata":{"source_lang":"en","target_lang":"pt"}`
+
+func TestMachineTranslateSameOnGinAndEcho(t *testing.T) {
+	for name, tc := range map[string]struct {
+		handler *fakeHandler
+		body    string
+		status  int
+	}{
+		"ok":       {&fakeHandler{}, `{"id":"1","segments":["Hello"],` + enPt + `}`, http.StatusOK},
+		"bad json": {&fakeHandler{}, `{"id":`, http.StatusBadRequest},
+		"invalid":  {&fakeHandler{}, `{"id":"1","segments":[]}`, http.StatusBadRequest},
+		"partial": {&fakeHandler{status: []model.SegmentStatus{{Status: model.SegmentFailed}}},
+			`{"id":"1","segments":["Hello"],"allow_partial":true,` + enPt + `}`, http.StatusMultiStatus},
+		"handler error": {&fakeHandler{err: fmt.Errorf("boom")}, `{"id":"1","segments":["Hello"],` + enPt + `}`, http.StatusInternalServerError},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ginRec, echoRec := serveBoth(t, &MTService{mtHandler: tc.handler}, tc.body)
+			assert.Equal(t, tc.status, ginRec.Code)
+			assert.Equal(t, tc.status, echoRec.Code)
+			assert.Equal(t, withoutRequestID(t, ginRec), withoutRequestID(t, echoRec))
+		})
+	}
+}
+
+func TestMachineTranslateValidation(t *testing.T) {
+	svc := &MTService{mtHandler: &fakeHandler{}, limits: model.RequestLimits{MaxSegmentChars: 3}}
+	r := svc.MachineTranslate(context.Background(), strings.NewReader(
+		`{"segments":["ok","too long"],"metadata":{"source_lang":"en","target_lang":"EN"}}`))
+	assert.Equal(t, http.StatusBadRequest, r.Status)
+	assert.Equal(t, []model.FieldError{
+		{Field: "metadata.target_lang", Code: model.CodeSameLanguage, Message: "must differ from source_lang"},
+		{Field: "segments[1]", Code: model.CodeTooLong, Message: "8 characters, the limit is 3"},
+	}, r.Body.(ErrorBody).Fields)
+}
+
+func TestMachineTranslatePassthrough(t *testing.T) {
+	svc := &MTService{mtHandler: &fakeHandler{err: fmt.Errorf("not called")},
+		limits: model.RequestLimits{AllowPassthrough: true}}
+	r := svc.MachineTranslate(context.Background(), strings.NewReader(
+		`{"id":"1","segments":["Hello"],"metadata":{"source_lang":"en","target_lang":"en"}}`))
+	assert.Equal(t, http.StatusOK, r.Status)
+	assert.Equal(t, []model.TargetSegment{"Hello"},
+		r.Body.(*model.MachineTranslationResponse).TargetSegments)
+}
+
+func TestErrorReplyMapping(t *testing.T) {
+	for name, tc := range map[string]struct {
+		err    error
+		status int
+		code   string
+	}{
+		"validation": {model.ValidationErrors{{Field: "segments"}}, http.StatusBadRequest, handler.CodeValidation},
+		"no route":   {&handler.NoRouteError{Route: "en->xx"}, http.StatusNotFound, handler.CodeNoRoute},
+		"upstream timeout": {fmt.Errorf("wrapped: %w", &handler.UpstreamError{
+			Host: "mt.local", Err: context.DeadlineExceeded}), http.StatusGatewayTimeout, handler.CodeUpstreamTimeout},
+		"upstream unavailable": {&handler.UpstreamError{Host: "mt.local", Err: handler.ErrUpstreamUnavailable},
+			http.StatusServiceUnavailable, handler.CodeUpstreamUnavailable},
+		"upstream 4xx": {&handler.UpstreamError{Host: "mt.local", StatusCode: 422, Err: fmt.Errorf("422")},
+			http.StatusBadGateway, handler.CodeUpstreamFailed},
+		"upstream 5xx": {&handler.UpstreamError{Host: "mt.local", Err: fmt.Errorf("giving up")},
+			http.StatusBadGateway, handler.CodeUpstreamFailed},
+		"cache":   {&handler.CacheError{Op: "fetch", Err: fmt.Errorf("disk")}, http.StatusInternalServerError, handler.CodeCacheFailed},
+		"unknown": {fmt.Errorf("boom"), http.StatusInternalServerError, handler.CodeInternal},
+		"deadline": {fmt.Errorf("waiting for batch: %w", context.DeadlineExceeded),
+			http.StatusGatewayTimeout, handler.CodeTimeout},
+		"cancelled": {context.Canceled, 499, handler.CodeCancelled},
+		"cancelled upstream": {&handler.UpstreamError{Host: "mt.local", Err: context.Canceled},
+			499, handler.CodeCancelled},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := errorReply(tc.err, "42")
+			assert.Equal(t, tc.status, r.Status)
+			assert.Equal(t, tc.code, r.Body.(ErrorBody).Code)
+			assert.Equal(t, "42", r.Body.(ErrorBody).RequestID)
+			assert.Equal(t, tc.err, r.Err)
+		})
+	}
+}